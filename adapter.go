@@ -0,0 +1,162 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"errors"
+	"io"
+)
+
+// borrower is a Writer with the WriteBorrowed
+type borrower interface {
+	WriteBorrowed(piece []byte) error
+}
+
+// ioWriter is io.Writer over a Writer
+type ioWriter struct {
+	w    Writer
+	size int // split size, 0 - don't split
+}
+
+// AsIOWriter returns io.Writer that writes each given
+// slice as a piece. The slice is borrowed, it's never
+// put to a Pool, and it's not retained after the Write.
+// After a timeout error the slice is written anyway: the
+// Writer keeps unwritten rest of the frame, and its Flush
+// finishes the frame. If the Writer has no WriteBorrowed
+// (e.g. an AsyncWriter), then a copy of the slice is
+// written by the Write.
+func AsIOWriter(w Writer) io.Writer {
+	return &ioWriter{w: w}
+}
+
+// AsIOWriterSplit is the AsIOWriter that splits given
+// slices to pieces of given size (and last one can be
+// shorter). The Write returns number of bytes of written
+// pieces. It panics if the size < 1.
+func AsIOWriterSplit(w Writer, size int) io.Writer {
+	if size < 1 {
+		panic("lend: split size is less than 1")
+	}
+	return &ioWriter{w: w, size: size}
+}
+
+// accepted returns length of given piece, if the Writer
+// has taken it, e.g. after a timeout, and 0 otherwise
+func accepted(piece []byte, err error) int {
+	if err == nil || isTimeout(err) && !errors.Is(err, ErrPending) {
+		return len(piece)
+	}
+	return 0
+}
+
+// write writes given borrowed piece
+func (i *ioWriter) write(piece []byte) error {
+	if b, ok := i.w.(borrower); ok {
+		return b.WriteBorrowed(piece)
+	}
+	own := make([]byte, len(piece))
+	copy(own, piece)
+	return i.w.Write(own)
+}
+
+func (i *ioWriter) Write(p []byte) (n int, err error) {
+	if i.size == 0 || len(p) <= i.size {
+		err = i.write(p)
+		return accepted(p, err), err
+	}
+	for n < len(p) {
+		piece := p[n:min(n+i.size, len(p))]
+		err = i.write(piece)
+		if n += accepted(piece, err); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// An IOReader is io.Reader over pieces of a Reader.
+// A Read never returns bytes of two pieces, and the
+// Boundary reports whether last Read reached end of
+// a piece. Empty pieces are skipped.
+type IOReader interface {
+	io.Reader
+	Boundary() bool
+}
+
+// noCopier is a Reader with the ReadNoCopy
+type noCopier interface {
+	ReadNoCopy() (piece []byte, err error)
+}
+
+// ioReader is an IOReader
+type ioReader struct {
+	r        Reader
+	whole    []byte // last piece read by the Read, to release
+	piece    []byte // unread rest of a piece
+	boundary bool
+}
+
+// AsIOReader returns IOReader that concatenates pieces
+// of given Reader. It reads pieces by the ReadNoCopy, if
+// the Reader has it, or by the Read otherwise (and then
+// a read piece is released, if the Reader has the Release).
+// Errors of the Reader are returned as is, and a clean
+// io.EOF is the end of the stream.
+func AsIOReader(r Reader) IOReader {
+	return &ioReader{r: r}
+}
+
+// next reads next piece
+func (i *ioReader) next() (err error) {
+	if q, ok := i.r.(noCopier); ok {
+		i.piece, err = q.ReadNoCopy()
+		return
+	}
+	if i.whole != nil {
+		releasePiece(i.r, i.whole)
+	}
+	i.piece, err = i.r.Read()
+	i.whole = i.piece
+	return
+}
+
+func (i *ioReader) Read(p []byte) (n int, err error) {
+	for len(i.piece) == 0 {
+		if err = i.next(); err != nil {
+			return
+		}
+	}
+	n = copy(p, i.piece)
+	i.piece = i.piece[n:]
+	i.boundary = len(i.piece) == 0
+	return
+}
+
+// Boundary reports whether last Read reached end of a piece.
+func (i *ioReader) Boundary() bool {
+	return i.boundary
+}
@@ -0,0 +1,193 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestAsIOWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, &Config{MaxSize: 100, Pool: new(maxPool)})
+	enc := json.NewEncoder(AsIOWriter(w))
+	for _, v := range []string{"one", "two"} {
+		if err := enc.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p := w.(*writer).pool.(*maxPool); p.puts != 0 {
+		t.Error("borrowed slices are put to the Pool")
+	}
+	r, _ := NewReader(buf, nil)
+	for _, want := range []string{"one", "two"} {
+		p, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if err := json.Unmarshal(p, &got); err != nil || got != want {
+			t.Errorf("unexpected result: %q, %v", got, err)
+		}
+	}
+}
+
+func TestAsIOWriterSplit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, &Config{MaxSize: 4})
+	n, err := io.Copy(AsIOWriterSplit(w, 4), strings.NewReader("0123456789"))
+	if err != nil || n != 10 {
+		t.Fatalf("unexpected result: %d, %v", n, err)
+	}
+	if s := readStrings(t, buf); len(s) != 3 || s[0] != "0123" ||
+		s[1] != "4567" || s[2] != "89" {
+		t.Error("wrong pieces:", s)
+	}
+	// partial write
+	w, _ = NewWriter(&limitWriter{w: io.Discard, n: 8}, &Config{MaxSize: 4})
+	n2, err := AsIOWriterSplit(w, 4).Write([]byte("0123456789"))
+	if err == nil || n2 != 4 {
+		t.Errorf("unexpected result: %d, %v", n2, err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("missing panic")
+		}
+	}()
+	AsIOWriterSplit(w, 0)
+}
+
+func TestAsIOWriter_timeout(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(&timeoutWriter{w: buf}, &Config{MaxSize: 4})
+	iw := AsIOWriterSplit(w, 4)
+	p := []byte("0123456789")
+	n, err := iw.Write(p)
+	if !isTimeout(err) || n != 4 {
+		t.Fatalf("unexpected result: %d, %v", n, err)
+	}
+	copy(p, "xxxx") // the slice is not retained
+	for p = p[n:]; len(p) > 0; p = p[n:] {
+		if n, err = iw.Write(p); err != nil && !isTimeout(err) {
+			t.Fatal(err)
+		}
+	}
+	for ; isTimeout(err); err = w.Flush() {
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := readStrings(t, buf); len(s) != 3 || s[0] != "0123" ||
+		s[1] != "4567" || s[2] != "89" {
+		t.Error("wrong pieces:", s)
+	}
+}
+
+// retainWriter is a Writer that retains written pieces
+type retainWriter struct {
+	pieces [][]byte
+}
+
+func (r *retainWriter) Write(piece []byte) error {
+	r.pieces = append(r.pieces, piece)
+	return nil
+}
+
+// a Writer without the WriteBorrowed
+func TestAsIOWriter_Writer(t *testing.T) {
+	rw := new(retainWriter)
+	p := []byte("0123456789")
+	if n, err := AsIOWriterSplit(rw, 4).Write(p); err != nil || n != len(p) {
+		t.Fatalf("unexpected result: %d, %v", n, err)
+	}
+	copy(p, "xxxxxxxxxx") // the slice is not retained
+	if len(rw.pieces) != 3 || string(rw.pieces[0]) != "0123" ||
+		string(rw.pieces[1]) != "4567" || string(rw.pieces[2]) != "89" {
+		t.Errorf("wrong pieces: %q", rw.pieces)
+	}
+}
+
+func TestAsIOReader(t *testing.T) {
+	r, _ := NewReader(writePieces(t, "one", "", "three"), nil)
+	ir := AsIOReader(r)
+	var got []string
+	var boundaries []bool
+	b := make([]byte, 3)
+	for {
+		n, err := ir.Read(b)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(b[:n]))
+		boundaries = append(boundaries, ir.Boundary())
+	}
+	if strings.Join(got, "|") != "one|thr|ee" {
+		t.Error("wrong data:", got)
+	}
+	if len(boundaries) != 3 || !boundaries[0] || boundaries[1] ||
+		!boundaries[2] {
+		t.Error("wrong boundaries:", boundaries)
+	}
+	// truncated
+	buf := writePieces(t, "one")
+	buf.Truncate(buf.Len() - 1)
+	r, _ = NewReader(buf, nil)
+	_, err := io.ReadAll(AsIOReader(r))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("wrong error, want io.ErrUnexpectedEOF, got:", err)
+	}
+}
+
+// releaseReader is a sliceReader with the Release
+type releaseReader struct {
+	sliceReader
+	released []string
+}
+
+func (r *releaseReader) Release(piece []byte) {
+	r.released = append(r.released, string(piece))
+}
+
+// a Reader without the ReadNoCopy
+func TestAsIOReader_Reader(t *testing.T) {
+	rr := &releaseReader{sliceReader: sliceReader{
+		pieces: []string{"one", "", "three"},
+	}}
+	got, err := io.ReadAll(AsIOReader(rr))
+	if err != nil || string(got) != "onethree" {
+		t.Errorf("unexpected result: %q, %v", got, err)
+	}
+	if strings.Join(rr.released, "|") != "one||three" {
+		t.Error("wrong released pieces:", rr.released)
+	}
+}
@@ -0,0 +1,224 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// A Policy is behavior of an AsyncWriter with full queue.
+type Policy int
+
+// policies of an AsyncWriter
+const (
+	Block      Policy = iota // wait for room in the queue
+	DropNewest               // drop given piece
+	DropOldest               // drop oldest piece of the queue
+	Fail                     // return ErrQueueFull
+)
+
+// ErrQueueFull is returned by an AsyncWriter with the Fail policy.
+var ErrQueueFull = errors.New("queue is full")
+
+// maxAsyncErrors is max number of errors kept
+// by an AsyncWriter between Flush calls
+const maxAsyncErrors = 64
+
+// An AsyncWriter writes pieces by a background goroutine.
+// The Write puts a piece to a queue, and full queue is
+// handled by a Policy. The queue keeps given pieces,
+// don't modify them after Write. Dropped pieces are not
+// put to a Pool. Errors of the goroutine are returned by
+// the Flush and the Close. After a timeout the rest of a
+// frame is written before next piece. An AsyncWriter is
+// safe for concurrent use.
+type AsyncWriter interface {
+	Write(piece []byte) (err error)
+	Flush() (err error)
+	Close() (err error)
+	Dropped() (n int64)
+}
+
+// flusher is a Writer with the Flush
+type flusher interface {
+	Flush() error
+}
+
+type asyncWriter struct {
+	w       Writer
+	wmu     sync.Mutex // lock of the w
+	policy  Policy
+	mu      sync.Mutex
+	cond    sync.Cond // the queue is changed
+	queue   [][]byte  // ring buffer
+	head, n int       // first piece and number of pieces
+	busy    bool      // a piece is being written
+	closed  bool
+	errs    []error // errors since last Flush
+	dropped int64
+	done    chan struct{} // the goroutine is done
+}
+
+// NewAsyncWriter creates an AsyncWriter over given Writer
+// with given length of the queue. Don't use the Writer
+// after that. The Flush and the Close of the Writer are
+// called, if it has them. It panics if queueLen < 1.
+func NewAsyncWriter(w Writer, queueLen int, policy Policy) AsyncWriter {
+	if queueLen < 1 {
+		panic("lend: queueLen of an AsyncWriter is less than 1")
+	}
+	a := &asyncWriter{
+		w:      w,
+		policy: policy,
+		queue:  make([][]byte, queueLen),
+		done:   make(chan struct{}),
+	}
+	a.cond.L = &a.mu
+	go a.run()
+	return a
+}
+
+// Write puts given piece to the queue. The piece is
+// handed over to the AsyncWriter: don't use or modify
+// it after the call, since it's written later, and
+// it's put to a Pool then, unless the Borrowed option
+// of the Writer is set. It returns io.ErrClosedPipe
+// after Close, and the piece is not taken then.
+func (a *asyncWriter) Write(piece []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for !a.closed && a.n == len(a.queue) {
+		switch a.policy {
+		case DropNewest:
+			a.dropped++
+			return nil
+		case DropOldest:
+			a.queue[a.head] = nil
+			a.head = (a.head + 1) % len(a.queue)
+			a.n--
+			a.dropped++
+		case Fail:
+			return ErrQueueFull
+		default:
+			a.cond.Wait()
+		}
+	}
+	if a.closed {
+		return io.ErrClosedPipe
+	}
+	a.queue[(a.head+a.n)%len(a.queue)] = piece
+	a.n++
+	a.cond.Broadcast()
+	return nil
+}
+
+// run writes pieces of the queue until it's closed and empty
+func (a *asyncWriter) run() {
+	defer close(a.done)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for {
+		for a.n == 0 && !a.closed {
+			a.cond.Wait()
+		}
+		if a.n == 0 {
+			return // closed
+		}
+		piece := a.queue[a.head]
+		a.queue[a.head] = nil
+		a.head = (a.head + 1) % len(a.queue)
+		a.n--
+		a.busy = true
+		a.cond.Broadcast() // room for blocked Write
+		a.mu.Unlock()
+		a.wmu.Lock()
+		err := a.w.Write(piece)
+		a.wmu.Unlock()
+		a.mu.Lock()
+		if a.busy = false; err != nil {
+			a.addErr(err)
+		}
+		a.cond.Broadcast()
+	}
+}
+
+func (a *asyncWriter) addErr(err error) {
+	if len(a.errs) < maxAsyncErrors {
+		a.errs = append(a.errs, err)
+	}
+}
+
+// wait for empty queue and returns collected errors
+func (a *asyncWriter) wait() (errs []error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.n > 0 || a.busy {
+		a.cond.Wait()
+	}
+	errs, a.errs = a.errs, nil
+	return
+}
+
+// Flush waits for the queue to be written and flushes
+// the Writer. It returns errors since last Flush.
+func (a *asyncWriter) Flush() error {
+	errs := a.wait()
+	a.wmu.Lock()
+	defer a.wmu.Unlock()
+	if f, ok := a.w.(flusher); ok {
+		errs = append(errs, f.Flush())
+	}
+	return errors.Join(errs...)
+}
+
+// Close writes the queue and closes the Writer. Next
+// writes return io.ErrClosedPipe. It returns errors
+// since last Flush.
+func (a *asyncWriter) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.cond.Broadcast()
+	a.mu.Unlock()
+	<-a.done
+	errs := a.wait()
+	if c, ok := a.w.(io.Closer); ok {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Dropped returns number of dropped pieces.
+func (a *asyncWriter) Dropped() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.dropped
+}
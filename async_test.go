@@ -0,0 +1,230 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gateWriter blocks writes until the gate is opened
+type gateWriter struct {
+	w       io.Writer
+	entered chan struct{} // first write is started
+	gate    chan struct{}
+}
+
+func newGateWriter(w io.Writer) *gateWriter {
+	return &gateWriter{
+		w:       w,
+		entered: make(chan struct{}),
+		gate:    make(chan struct{}),
+	}
+}
+
+func (g *gateWriter) Write(p []byte) (int, error) {
+	select {
+	case <-g.entered:
+	default:
+		close(g.entered)
+	}
+	<-g.gate
+	return g.w.Write(p)
+}
+
+// readStrings reads all pieces
+func readStrings(t *testing.T, r io.Reader) (pieces []string) {
+	t.Helper()
+	lr, _ := NewReader(r, nil)
+	for {
+		p, err := lr.Read()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		pieces = append(pieces, string(p))
+	}
+}
+
+func TestAsyncWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, nil)
+	a := NewAsyncWriter(w, 4, Block)
+	var want []string
+	for i := 0; i < 100; i++ {
+		want = append(want, fmt.Sprint(i))
+		if err := a.Write([]byte(want[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Error("wrong error, want io.ErrClosedPipe, got:", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if got := readStrings(t, buf); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Error("wrong pieces:", got)
+	}
+}
+
+// sliceWriter is a Writer that keeps written pieces
+type sliceWriter struct {
+	pieces []string
+}
+
+func (s *sliceWriter) Write(piece []byte) error {
+	s.pieces = append(s.pieces, string(piece))
+	return nil
+}
+
+// a Writer without the Flush and the Close
+func TestAsyncWriter_Writer(t *testing.T) {
+	sw := new(sliceWriter)
+	a := NewAsyncWriter(sw, 4, Block)
+	for _, p := range []string{"one", "two"} {
+		if err := a.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sw.pieces) != "[one two]" {
+		t.Error("wrong pieces:", sw.pieces)
+	}
+}
+
+// fillAsync returns AsyncWriter with the full queue of
+// given length; first piece is being written, and the
+// writing is blocked until the gate is opened
+func fillAsync(t *testing.T, n int, p Policy) (AsyncWriter, *gateWriter,
+	*bytes.Buffer) {
+	buf := new(bytes.Buffer)
+	g := newGateWriter(buf)
+	w, _ := NewWriter(g, nil)
+	a := NewAsyncWriter(w, n, p)
+	a.Write([]byte("0"))
+	<-g.entered
+	for i := 1; i <= n; i++ {
+		if err := a.Write([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a, g, buf
+}
+
+func TestAsyncWriter_policy(t *testing.T) {
+	for _, c := range []struct {
+		policy  Policy
+		err     error
+		dropped int64
+		want    string
+	}{
+		{DropNewest, nil, 1, "[0 1 2]"},
+		{DropOldest, nil, 1, "[0 2 x]"},
+		{Fail, ErrQueueFull, 0, "[0 1 2]"},
+	} {
+		a, g, buf := fillAsync(t, 2, c.policy)
+		if err := a.Write([]byte("x")); err != c.err {
+			t.Errorf("wrong error, want %v, got %v", c.err, err)
+		}
+		close(g.gate)
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if a.Dropped() != c.dropped {
+			t.Error("wrong number of dropped pieces:", a.Dropped())
+		}
+		if got := fmt.Sprint(readStrings(t, buf)); got != c.want {
+			t.Errorf("wrong pieces, want %s, got %s", c.want, got)
+		}
+	}
+}
+
+func TestAsyncWriter_block(t *testing.T) {
+	a, g, buf := fillAsync(t, 2, Block)
+	done := make(chan error)
+	go func() { done <- a.Write([]byte("3")) }()
+	select {
+	case <-done:
+		t.Fatal("the Write is not blocked")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(g.gate)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(readStrings(t, buf)); got != "[0 1 2 3]" {
+		t.Error("wrong pieces:", got)
+	}
+	a.Close()
+}
+
+func TestAsyncWriter_errors(t *testing.T) {
+	w, _ := NewWriter(errorWriter{}, &Config{MaxSize: 5})
+	a := NewAsyncWriter(w, 4, Block)
+	a.Write([]byte("too large"))
+	a.Write([]byte("piece"))
+	err := a.Flush()
+	if !errors.Is(err, ErrSizeLimit) || !strings.Contains(fmt.Sprint(err),
+		"some error") {
+		t.Error("wrong error:", err)
+	}
+	if err := a.Flush(); err != nil {
+		t.Error("errors are not cleared:", err)
+	}
+	a.Write([]byte("piece"))
+	if err := a.Close(); err == nil {
+		t.Error("missing error")
+	}
+}
+
+func TestNewAsyncWriter_panic(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("missing panic")
+		}
+	}()
+	w, _ := NewWriter(io.Discard, nil)
+	NewAsyncWriter(w, 0, Block)
+}
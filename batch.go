@@ -0,0 +1,168 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import "io"
+
+// WriteBatch writes given pieces by one call of underlying
+// io.Writer (by one writev for a TCP or Unix connection).
+// Pieces larger than 4KiB are not copied, and without the
+// writev they are written by separate calls. All pieces
+// are checked first, and if one of them exceeds the
+// MaxSize, then nothing is written. The WriteBatch returns
+// number of written pieces. On a timeout in the middle of
+// a frame, the Writer keeps the rest of the frame, like the
+// Write, and the piece is counted. Write pieces[n:] later.
+// Written pieces are owned, unless the Borrowed option
+// is set.
+func (w *writer) WriteBatch(pieces [][]byte) (n int, err error) {
+	if w.err != nil {
+		return 0, broken(w.err)
+	}
+	for _, piece := range pieces {
+		if len(piece) > w.max {
+			return 0, ErrSizeLimit
+		}
+	}
+	if w.debug && w.borrowed {
+		for _, piece := range pieces {
+			borrowed.add(piece)
+		}
+	}
+	if w.frame == framePiece {
+		if err = w.writeFrame(); err != nil {
+			return 0, pending(err)
+		}
+	}
+	if err = w.finish(); err != nil {
+		return
+	}
+	rest := pieces
+	if len(rest) == 0 {
+		return
+	}
+	w.encodeBatch(rest)
+	var written int64
+	if w.vectored {
+		w.vec = w.batchVec
+		written, err = w.vec.WriteTo(w.w)
+	} else {
+		written, err = w.writeBatch()
+	}
+	var done int // written pieces
+	for done < len(rest) && w.ends[done] <= written {
+		if !w.borrowed {
+			w.put(rest[done])
+		}
+		done++
+	}
+	if n += done; err == nil {
+		return
+	}
+	var start int64 // start of the unwritten frame
+	if done > 0 {
+		start = w.ends[done-1]
+	}
+	if written == start {
+		return // at the boundary of a frame
+	}
+	if !isTimeout(err) {
+		return n, w.fail(err) // in the middle of a frame
+	}
+	// keep the rest of the frame
+	piece := rest[done]
+	w.frame, w.piece, w.owned = framePiece, piece, !w.borrowed
+	w.bufs[0], w.bufs[1], w.bufs[2] = w.heading, w.putLen(len(piece)), piece
+	if w.checksum {
+		w.bufs[3] = w.sum(piece)
+	}
+	w.advance(written - start)
+	w.sent = true
+	w.keep()
+	n++
+	return
+}
+
+// encodeBatch encodes frames of given pieces to the batch
+// buffer; the batchVec is the buffer and large pieces, and
+// the ends is end of each frame in the batch
+func (w *writer) encodeBatch(pieces [][]byte) {
+	var size int
+	for _, piece := range pieces {
+		size += len(w.heading) + len(w.putLen(len(piece)))
+		if w.checksum {
+			size += len(w.sumb)
+		}
+		if len(piece) <= coalesceMax {
+			size += len(piece)
+		}
+	}
+	if cap(w.batch) < size {
+		w.batch = make([]byte, 0, size) // the append doesn't move it
+	}
+	b, vec, ends := w.batch[:0], w.batchVec[:0], w.ends[:0]
+	var start int   // start of current part of the batch
+	var total int64 // size of the frames
+	for _, piece := range pieces {
+		mark := len(b)
+		b = append(b, w.heading...)
+		b = append(b, w.putLen(len(piece))...)
+		if len(piece) <= coalesceMax {
+			b = append(b, piece...)
+		} else {
+			vec = append(vec, b[start:], piece)
+			start = len(b)
+		}
+		if w.checksum {
+			b = append(b, w.sum(piece)...)
+		}
+		if total += int64(len(b) - mark); len(piece) > coalesceMax {
+			total += int64(len(piece))
+		}
+		ends = append(ends, total)
+	}
+	if start < len(b) {
+		vec = append(vec, b[start:])
+	}
+	w.batch, w.batchVec, w.ends = b, vec, ends
+}
+
+// writeBatch writes the batchVec without writev
+func (w *writer) writeBatch() (written int64, err error) {
+	var m int
+	for _, b := range w.batchVec {
+		for len(b) > 0 {
+			if m, err = w.w.Write(b); err == nil && m == 0 {
+				err = io.ErrShortWrite
+			}
+			b = b[m:]
+			if written += int64(m); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,204 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+var batchConfigs = []*Config{
+	{MaxSize: 2 * coalesceMax},
+	{MaxSize: 2 * coalesceMax, Varint: true},
+	{MaxSize: 2 * coalesceMax, Heading: []byte("HEAD"), Checksum: true},
+	{MaxSize: maxInt, Checksum: true},
+}
+
+var batchPieces = [][]byte{
+	[]byte("one"), {}, largePiece, []byte("two"), largePiece, []byte("three"),
+}
+
+// readBatch reads and checks the batchPieces
+func readBatch(t *testing.T, r io.Reader, c *Config) {
+	t.Helper()
+	lr, _ := NewReader(r, c)
+	for _, want := range batchPieces {
+		p, err := lr.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, want) {
+			t.Errorf("wrong piece, want %d bytes, got %d", len(want), len(p))
+		}
+	}
+	if _, err := lr.Read(); err != io.EOF {
+		t.Error("wrong error, want io.EOF, got:", err)
+	}
+}
+
+func TestWriter_WriteBatch(t *testing.T) {
+	for _, c := range batchConfigs {
+		buf := new(bytes.Buffer)
+		cw := &countWriter{w: buf}
+		w, _ := NewWriter(cw, c)
+		n, err := w.WriteBatch(batchPieces)
+		if err != nil || n != len(batchPieces) {
+			t.Fatalf("unexpected result: %d, %v", n, err)
+		}
+		if cw.writes != 5 { // two large pieces are not copied
+			t.Error("wrong number of writes:", cw.writes)
+		}
+		readBatch(t, buf, c)
+		// small pieces
+		cw.writes = 0
+		w.WriteBatch([][]byte{[]byte("one"), []byte("two")})
+		if cw.writes != 1 {
+			t.Error("wrong number of writes:", cw.writes)
+		}
+	}
+}
+
+func TestWriter_WriteBatch_size_limit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, &Config{MaxSize: 5})
+	n, err := w.WriteBatch([][]byte{[]byte("one"), []byte("too large")})
+	if n != 0 || err != ErrSizeLimit {
+		t.Errorf("unexpected result: %d, %v", n, err)
+	}
+	if buf.Len() != 0 {
+		t.Error("written:", buf.Len())
+	}
+}
+
+// limitWriter writes n bytes and returns an error then
+type limitWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitWriter) Write(p []byte) (n int, err error) {
+	if len(p) > l.n {
+		p, err = p[:l.n], errors.New("some error")
+	}
+	n, _ = l.w.Write(p)
+	l.n -= n
+	return
+}
+
+func TestWriter_WriteBatch_error(t *testing.T) {
+	pieces := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	for _, c := range []struct {
+		limit  int
+		n      int
+		broken bool
+	}{
+		{0, 0, false},
+		{7, 1, false},
+		{9, 1, true},
+		{14, 2, false},
+	} {
+		p := new(maxPool)
+		w, _ := NewWriter(&limitWriter{w: io.Discard, n: c.limit},
+			&Config{MaxSize: 100, Pool: p})
+		n, err := w.WriteBatch(pieces)
+		if err == nil || n != c.n {
+			t.Errorf("unexpected result: %d, %v", n, err)
+		}
+		if (w.Err() != nil) != c.broken {
+			t.Error("wrong broken state:", w.Err())
+		}
+		if p.puts != c.n {
+			t.Errorf("written pieces are not put: %d", p.puts)
+		}
+	}
+}
+
+func TestWriter_WriteBatch_timeout(t *testing.T) {
+	for _, c := range batchConfigs {
+		buf := new(bytes.Buffer)
+		w, _ := NewWriter(&timeoutWriter{w: buf}, c)
+		var n, timeouts int
+		for n < len(batchPieces) {
+			m, err := w.WriteBatch(batchPieces[n:])
+			if n += m; isTimeout(err) {
+				timeouts++
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if timeouts == 0 {
+			t.Error("no timeouts")
+		}
+		for err := w.Flush(); err != nil; err = w.Flush() {
+			if !isTimeout(err) {
+				t.Fatal(err)
+			}
+		}
+		readBatch(t, buf, c)
+	}
+}
+
+func TestWriter_WriteBatch_borrowed(t *testing.T) {
+	p := new(maxPool)
+	w, _ := NewWriter(io.Discard, &Config{MaxSize: 100, Pool: p,
+		Borrowed: true})
+	w.WriteBatch([][]byte{[]byte("one"), []byte("two")})
+	if p.puts != 0 {
+		t.Error("borrowed pieces are put to the Pool")
+	}
+}
+
+func TestWriter_WriteBatch_vectored(t *testing.T) {
+	client, server := tcpPair(t)
+	defer server.Close()
+	c := batchConfigs[2]
+	w, _ := NewWriter(client, c)
+	go func() {
+		defer client.Close()
+		if _, err := w.WriteBatch(batchPieces); err != nil {
+			t.Error(err)
+		}
+	}()
+	readBatch(t, server, c)
+}
+
+func BenchmarkWriter_WriteBatch(b *testing.B) {
+	cw := &countWriter{w: io.Discard}
+	w, _ := NewWriter(cw, &Config{MaxSize: 100, Checksum: true})
+	pieces := make([][]byte, 32)
+	for i := range pieces {
+		pieces[i] = []byte("small piece of data")
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.WriteBatch(pieces); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(cw.writes)/float64(b.N*len(pieces)), "writes/piece")
+}
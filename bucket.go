@@ -0,0 +1,112 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// A BucketPool is a Pool with size classes. It keeps
+// pieces in power-of-two sync.Pool buckets between
+// given min and max sizes. Pieces greater than the max
+// size are allocated by make and are never kept. A
+// BucketPool is safe for concurrent use.
+type BucketPool struct {
+	shift   int // log2 of the min size
+	max     int // max size, power of two
+	buckets []sync.Pool
+
+	hits, misses, oversize atomic.Int64
+}
+
+// BucketStats is statistics of a BucketPool.
+type BucketStats struct {
+	Hits     int64 // pieces reused
+	Misses   int64 // pieces allocated for a bucket
+	Oversize int64 // pieces greater than the max size
+}
+
+// NewBucketPool creates a BucketPool. The min and
+// max sizes are rounded up to a power of two. It
+// panics if minSize < 1 or maxSize < minSize.
+func NewBucketPool(minSize, maxSize int) *BucketPool {
+	if minSize < 1 || maxSize < minSize {
+		panic("lend: invalid sizes of a BucketPool")
+	}
+	shift := bits.Len(uint(minSize - 1))
+	top := bits.Len(uint(maxSize - 1))
+	return &BucketPool{
+		shift:   shift,
+		max:     1 << top,
+		buckets: make([]sync.Pool, top-shift+1),
+	}
+}
+
+// bucket returns index of a bucket for given size
+func (p *BucketPool) bucket(size int) (i int) {
+	if size <= 1<<p.shift {
+		return 0
+	}
+	return bits.Len(uint(size-1)) - p.shift
+}
+
+// Get returns a piece with length equal to given size.
+func (p *BucketPool) Get(size int) []byte {
+	if size > p.max {
+		p.oversize.Add(1)
+		return make([]byte, size)
+	}
+	i := p.bucket(size)
+	if ptr, ok := p.buckets[i].Get().(*byte); ok {
+		p.hits.Add(1)
+		return unsafe.Slice(ptr, 1<<(p.shift+i))[:size]
+	}
+	p.misses.Add(1)
+	return make([]byte, size, 1<<(p.shift+i))
+}
+
+// Put puts given piece to a bucket. Pieces with
+// capacity that doesn't match a bucket are dropped.
+func (p *BucketPool) Put(piece []byte) {
+	c := cap(piece)
+	if c == 0 || c > p.max || c&(c-1) != 0 || c < 1<<p.shift {
+		return // not from the pool
+	}
+	// keep pointer to the array; it doesn't allocate
+	p.buckets[p.bucket(c)].Put(unsafe.SliceData(piece[:c]))
+}
+
+// Stats returns statistics of the BucketPool.
+func (p *BucketPool) Stats() BucketStats {
+	return BucketStats{
+		Hits:     p.hits.Load(),
+		Misses:   p.misses.Load(),
+		Oversize: p.oversize.Load(),
+	}
+}
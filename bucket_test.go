@@ -0,0 +1,121 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNewBucketPool(t *testing.T) {
+	p := NewBucketPool(100, 1000)
+	if p.shift != 7 || p.max != 1024 || len(p.buckets) != 4 {
+		t.Error("wrong buckets:", p.shift, p.max, len(p.buckets))
+	}
+	for _, sizes := range [][2]int{{0, 10}, {10, 5}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("missing panic:", sizes)
+				}
+			}()
+			NewBucketPool(sizes[0], sizes[1])
+		}()
+	}
+}
+
+func TestBucketPool_Get(t *testing.T) {
+	p := NewBucketPool(16, 1024)
+	for _, c := range []struct{ size, cap int }{
+		{0, 16}, {1, 16}, {16, 16}, {17, 32}, {500, 512}, {1024, 1024},
+		{1025, 1025},
+	} {
+		piece := p.Get(c.size)
+		if len(piece) != c.size || cap(piece) != c.cap {
+			t.Errorf("Get(%d): len %d, cap %d", c.size, len(piece),
+				cap(piece))
+		}
+	}
+	if s := p.Stats(); s != (BucketStats{Misses: 6, Oversize: 1}) {
+		t.Error("wrong stats:", s)
+	}
+}
+
+func TestBucketPool_Put(t *testing.T) {
+	p := NewBucketPool(16, 1024)
+	piece := p.Get(100)
+	p.Put(piece)
+	p.Put(make([]byte, 100))  // dropped
+	p.Put(make([]byte, 2048)) // dropped
+	p.Put(make([]byte, 8))    // dropped
+	got := p.Get(120)
+	if len(got) != 120 || cap(got) != 128 {
+		t.Error("wrong piece:", len(got), cap(got))
+	}
+	// sync.Pool may drop a piece, it's not an error
+	if s := p.Stats(); s.Hits+s.Misses != 2 {
+		t.Error("wrong stats:", s)
+	}
+}
+
+func TestBucketPool_lend(t *testing.T) {
+	p := NewBucketPool(16, 1024)
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, &Config{MaxSize: 2048, Pool: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(&buf, &Config{MaxSize: 2048, Pool: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 10, 100, 2000} {
+		piece := p.Get(size)
+		for i := range piece {
+			piece[i] = byte(i)
+		}
+		want := append([]byte{}, piece...)
+		if err := w.Write(piece); err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Error("wrong piece of size", size)
+		}
+		r.Release(got)
+	}
+}
+
+func BenchmarkBucketPool(b *testing.B) {
+	p := NewBucketPool(16, 64<<10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.Put(p.Get(1000))
+	}
+}
@@ -0,0 +1,126 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrBudgetExhausted means a Budget has no room for a piece.
+	ErrBudgetExhausted = errors.New("budget exhausted")
+	// ErrBudgetLimit means a piece is larger than limit of a
+	// Budget. A Reader skips such piece, since it never fits.
+	ErrBudgetLimit = errors.New("piece exceeds budget limit")
+)
+
+// A Budget limits total size of pieces held by many
+// Readers. A Reader acquires length of a piece before
+// allocating it, and the piece is charged until it's
+// released. Use Release of the Reader when a piece
+// is no longer used (or Release(len(piece)) of the
+// Budget, if the piece is not from a Pool). A Budget
+// is safe for concurrent use. See Config.Budget.
+type Budget struct {
+	mu    sync.Mutex
+	limit int
+	used  int
+	wait  chan struct{} // closed on release
+}
+
+// NewBudget creates a Budget with given limit in bytes.
+func NewBudget(limit int) *Budget {
+	return &Budget{limit: limit}
+}
+
+// Limit returns limit of the Budget.
+func (b *Budget) Limit() int {
+	return b.limit
+}
+
+// Used returns number of acquired bytes.
+func (b *Budget) Used() (used int) {
+	b.mu.Lock()
+	used = b.used
+	b.mu.Unlock()
+	return
+}
+
+// TryAcquire acquires n bytes if it's possible
+// without blocking and reports success.
+func (b *Budget) TryAcquire(n int) (ok bool) {
+	b.mu.Lock()
+	if ok = n <= b.limit-b.used; ok {
+		b.used += n
+	}
+	b.mu.Unlock()
+	return
+}
+
+// Acquire acquires n bytes, blocking until other
+// side releases enough bytes or given context is
+// done. If n is greater than limit of the Budget,
+// then ErrBudgetExhausted is returned immediately.
+func (b *Budget) Acquire(ctx context.Context, n int) error {
+	if n > b.limit {
+		return ErrBudgetExhausted
+	}
+	for {
+		b.mu.Lock()
+		if n <= b.limit-b.used {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		if b.wait == nil {
+			b.wait = make(chan struct{})
+		}
+		wait := b.wait
+		b.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+// Release releases n bytes. It panics if
+// it releases more than acquired.
+func (b *Budget) Release(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.used {
+		panic("lend: Budget released more than acquired")
+	}
+	b.used -= n
+	if b.wait != nil {
+		close(b.wait)
+		b.wait = nil
+	}
+}
@@ -0,0 +1,411 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	b := NewBudget(10)
+	if b.Limit() != 10 {
+		t.Error("wrong limit:", b.Limit())
+	}
+	if !b.TryAcquire(7) {
+		t.Fatal("can't acquire")
+	}
+	if b.TryAcquire(4) {
+		t.Error("acquired more than limit")
+	}
+	if b.Used() != 7 {
+		t.Error("wrong used:", b.Used())
+	}
+	b.Release(7)
+	if b.Used() != 0 {
+		t.Error("wrong used:", b.Used())
+	}
+}
+
+func TestBudget_Acquire(t *testing.T) {
+	b := NewBudget(10)
+	if err := b.Acquire(context.Background(), 11); err != ErrBudgetExhausted {
+		t.Error("wrong error, want ErrBudgetExhausted, got:", err)
+	}
+	if err := b.Acquire(context.Background(), 8); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- b.Acquire(context.Background(), 5) }()
+	select {
+	case <-done:
+		t.Fatal("Acquire doesn't block")
+	case <-time.After(10 * time.Millisecond):
+	}
+	b.Release(8)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if b.Used() != 5 {
+		t.Error("wrong used:", b.Used())
+	}
+}
+
+func TestBudget_Acquire_context(t *testing.T) {
+	b := NewBudget(10)
+	b.TryAcquire(10)
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	if err := b.Acquire(ctx, 1); err != context.DeadlineExceeded {
+		t.Error("wrong error, want context.DeadlineExceeded, got:", err)
+	}
+}
+
+func TestBudget_Release_panic(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("missing panic")
+		}
+	}()
+	NewBudget(10).Release(1)
+}
+
+func writePieces(t *testing.T, pieces ...string) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range pieces {
+		if err := w.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf
+}
+
+func Test_reader_budget(t *testing.T) {
+	b := NewBudget(10)
+	c := &Config{MaxSize: 100, Budget: b}
+	r1, err := NewReader(writePieces(t, "hello", "world"), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := NewReader(writePieces(t, "hey"), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, err := r1.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := r1.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r2.Read(); err != ErrBudgetExhausted {
+		t.Fatal("wrong error, want ErrBudgetExhausted, got:", err)
+	}
+	b.Release(len(p1))
+	b.Release(len(p2))
+	// continue the same piece
+	if p, err := r2.Read(); err != nil {
+		t.Error(err)
+	} else if string(p) != "hey" {
+		t.Errorf("wrong data, want %q, got %q", "hey", string(p))
+	}
+	if b.Used() != 3 {
+		t.Error("wrong used:", b.Used())
+	}
+}
+
+func Test_reader_budget_error(t *testing.T) {
+	b := NewBudget(10)
+	buf := writePieces(t, "hello")
+	buf.Truncate(buf.Len() - 1)
+	r, err := NewReader(buf, &Config{MaxSize: 100, Budget: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); err == nil {
+		t.Error("missing error")
+	}
+	if b.Used() != 0 {
+		t.Error("budget is not released on error:", b.Used())
+	}
+}
+
+func Test_reader_budget_heading(t *testing.T) {
+	b := NewBudget(10)
+	b.TryAcquire(10)
+	c := &Config{MaxSize: 100, Budget: b, Heading: []byte("HEAD")}
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, c)
+	w.Write([]byte("hello"))
+	r, err := NewReader(buf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); err != ErrBudgetExhausted {
+		t.Fatal("wrong error, want ErrBudgetExhausted, got:", err)
+	}
+	b.Release(10)
+	if p, err := r.Read(); err != nil {
+		t.Error(err)
+	} else if string(p) != "hello" {
+		t.Errorf("wrong data, want %q, got %q", "hello", string(p))
+	}
+}
+
+func Test_reader_budget_wait(t *testing.T) {
+	b := NewBudget(10)
+	b.TryAcquire(8)
+	r, err := NewReader(writePieces(t, "hello"), &Config{
+		MaxSize:    100,
+		Budget:     b,
+		BudgetWait: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := r.ReadContext(ctx); err != context.Canceled {
+		t.Fatal("wrong error, want context.Canceled, got:", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.Release(8)
+	}()
+	if p, err := r.Read(); err != nil {
+		t.Error(err)
+	} else if string(p) != "hello" {
+		t.Errorf("wrong data, want %q, got %q", "hello", string(p))
+	}
+}
+
+func Test_reader_budget_incremental(t *testing.T) {
+	size := 3 * incrementalChunk
+	other := size - incrementalChunk - 10 // held by another Reader
+	b := NewBudget(size)
+	b.TryAcquire(other)
+	buf := writePieces(t, string(make([]byte, size)))
+	r, err := NewReader(buf, &Config{
+		MaxSize:     maxInt32,
+		Budget:      b,
+		Incremental: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); err != ErrBudgetExhausted {
+		t.Fatal("wrong error, want ErrBudgetExhausted, got:", err)
+	}
+	if b.Used() != other+incrementalChunk {
+		t.Error("wrong used:", b.Used())
+	}
+	b.Release(other)
+	if p, err := r.Read(); err != nil {
+		t.Error(err)
+	} else if len(p) != size {
+		t.Errorf("wrong length, want %d, got %d", size, len(p))
+	}
+	if b.Used() != size {
+		t.Error("wrong used:", b.Used())
+	}
+}
+
+func Test_reader_budget_incremental_error(t *testing.T) {
+	b := NewBudget(maxInt32)
+	buf := writePieces(t, string(make([]byte, 3*incrementalChunk)))
+	buf.Truncate(buf.Len() - 1)
+	r, err := NewReader(buf, &Config{
+		MaxSize:     maxInt32,
+		Budget:      b,
+		Incremental: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); err == nil {
+		t.Error("missing error")
+	}
+	if b.Used() != 0 {
+		t.Error("budget is not released on error:", b.Used())
+	}
+}
+
+func Test_reader_budget_limit(t *testing.T) {
+	for _, c := range []*Config{
+		{MaxSize: 100 << 10},
+		{MaxSize: 100 << 10, Incremental: true},
+		{MaxSize: 100 << 10, Incremental: true, BudgetWait: true},
+		{MaxSize: 100 << 10, Chunked: true},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		b := NewBudget(6000)
+		c.Budget = b
+		buf := new(bytes.Buffer)
+		w, err := NewWriter(buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write(make([]byte, 10000)); err != nil {
+			t.Fatal(err)
+		}
+		if c.Chunked {
+			pw, _ := w.NextWriter(-1) // chunks of 4000 bytes
+			for i := 0; i < 3; i++ {
+				pw.Write(make([]byte, 4000))
+			}
+			pw.Close()
+		}
+		w.Write([]byte("next"))
+		r, err := NewReader(buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1+btoi(c.Chunked); i++ {
+			_, err = r.ReadContext(ctx)
+			if !errors.Is(err, ErrBudgetLimit) {
+				t.Fatal("wrong error, want ErrBudgetLimit, got:", err)
+			}
+			if b.Used() != 0 {
+				t.Error("budget is not released:", b.Used())
+			}
+		}
+		if p, err := r.ReadContext(ctx); err != nil {
+			t.Error(err)
+		} else if string(p) != "next" {
+			t.Errorf("wrong data, want %q, got %q", "next", string(p))
+		}
+		cancel()
+	}
+}
+
+// a waiting Reader charges received data, not declared length
+func Test_reader_budget_wait_declared(t *testing.T) {
+	b := NewBudget(2 << 20)
+	buf := writePieces(t, string(make([]byte, 1<<20)))
+	buf.Truncate(4 + 3) // length and 3 bytes of the piece
+	r, err := NewReader(&timeoutReader{r: buf}, &Config{
+		MaxSize:     2 << 20,
+		Budget:      b,
+		BudgetWait:  true,
+		Incremental: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err = r.Read(); isTimeout(err); _, err = r.Read() {
+		if b.Used() > incrementalChunk {
+			t.Fatal("declared length is charged:", b.Used())
+		}
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("wrong error, want io.ErrUnexpectedEOF, got:", err)
+	}
+	if b.Used() != 0 {
+		t.Error("budget is not released:", b.Used())
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Readers that wait for the Budget must not hold parts of pieces
+func Test_reader_budget_wait_partial(t *testing.T) {
+	const size = 6000
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := &Config{
+		MaxSize:     1 << 20,
+		Budget:      NewBudget(8192),
+		BudgetWait:  true,
+		Incremental: true,
+	}
+	frame := writePieces(t, string(make([]byte, size))).Bytes()
+	var pws [2]*io.PipeWriter
+	errs := make(chan error, len(pws))
+	for i := range pws {
+		pr, pw := io.Pipe()
+		pws[i] = pw
+		r, err := NewReader(pr, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			p, err := r.ReadContext(ctx)
+			if err == nil {
+				r.Release(p)
+			}
+			errs <- err
+		}()
+		go pw.Write(frame[:100]) // part of the piece
+	}
+	time.Sleep(10 * time.Millisecond)
+	for _, pw := range pws {
+		go pw.Write(frame[100:])
+	}
+	for range pws {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if c.Budget.Used() != 0 {
+		t.Error("wrong used:", c.Budget.Used())
+	}
+}
+
+func Test_packet_budget(t *testing.T) {
+	src, dst := listenPacket(t), listenPacket(t)
+	defer src.Close()
+	defer dst.Close()
+	b := NewBudget(4)
+	c := &Config{MaxSize: 100, Budget: b}
+	w, _ := NewPacketWriter(src, c)
+	r, err := NewPacketReader(dst, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteTo([]byte("abc"), dst.LocalAddr())
+	w.WriteTo([]byte("def"), dst.LocalAddr())
+	if _, _, err := r.ReadFrom(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.ReadFrom(); err != ErrBudgetExhausted {
+		t.Error("wrong error, want ErrBudgetExhausted, got:", err)
+	}
+}
@@ -0,0 +1,242 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// A Frame is a piece read by a ReadChan or an error.
+type Frame struct {
+	Piece []byte
+	Err   error
+}
+
+// aLongTimeAgo is a deadline that unblocks I/O
+var aLongTimeAgo = time.Unix(1, 0)
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// errer is a Reader or a Writer with the Err
+type errer interface {
+	Err() error
+}
+
+// releaser is a Reader with the Release
+type releaser interface {
+	Release(piece []byte)
+}
+
+// isBroken reports whether given Reader or Writer
+// is broken, if it has the Err
+func isBroken(x any) bool {
+	e, ok := x.(errer)
+	return ok && e.Err() != nil
+}
+
+// releasePiece puts given piece back, if given
+// Reader has the Release
+func releasePiece(r Reader, piece []byte) {
+	if q, ok := r.(releaser); ok {
+		q.Release(piece)
+	}
+}
+
+// source returns underlying io.Reader of given Reader
+func source(r Reader) io.Reader {
+	if q, ok := r.(*reader); ok {
+		return q.src
+	}
+	return nil
+}
+
+// destination returns underlying io.Writer of given Writer
+func destination(w Writer) io.Writer {
+	switch q := w.(type) {
+	case *writer:
+		return q.dst
+	case *syncWriter:
+		return q.w.dst
+	}
+	return nil
+}
+
+// interrupt maps deadline of given context to I/O of
+// given io.Reader or io.Writer, and it unblocks the I/O
+// when the context is done: it sets a deadline in the
+// past, or closes it; the stop reports whether the I/O
+// is interrupted, and it resets the deadline
+func interrupt(ctx context.Context, x any, read bool) (stop func() bool) {
+	var set func(time.Time) error
+	if d, ok := x.(readDeadliner); ok && read {
+		set = d.SetReadDeadline
+	} else if d, ok := x.(writeDeadliner); ok && !read {
+		set = d.SetWriteDeadline
+	}
+	c, _ := x.(io.Closer)
+	if set == nil && c == nil {
+		return func() bool { return false }
+	}
+	dl, hasDeadline := ctx.Deadline()
+	if set != nil && hasDeadline {
+		set(dl)
+	}
+	done := make(chan struct{})
+	after := context.AfterFunc(ctx, func() {
+		defer close(done)
+		if set != nil {
+			set(aLongTimeAgo)
+		} else {
+			c.Close()
+		}
+	})
+	return func() (interrupted bool) {
+		if interrupted = !after(); interrupted {
+			<-done
+		}
+		if set != nil && (interrupted || hasDeadline) {
+			set(time.Time{})
+		}
+		return
+	}
+}
+
+// ctxErr returns error of given context instead
+// of a timeout caused by deadline of the context
+func ctxErr(ctx context.Context, err error) error {
+	if !isTimeout(err) {
+		return err
+	}
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	if dl, ok := ctx.Deadline(); ok && !time.Now().Before(dl) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// more reports whether a Reader can read next
+// piece after given error
+func more(r Reader, err error) bool {
+	return !isBroken(r) && (errors.Is(err, ErrSizeLimit) ||
+		errors.Is(err, ErrChecksum) || errors.Is(err, ErrNegativeLength))
+}
+
+// ReadChan reads pieces by a goroutine and sends them to
+// returned channel. The channel is closed on an error
+// (after sending it), if the Reader can't continue, e.g.
+// io.EOF, or when given context is done. The goroutine is
+// unblocked on the context, if underlying io.Reader is a
+// net.Conn (a deadline is set and then reset), or if it's
+// an io.Closer (it's closed). Release pieces when they
+// are no longer used. Pieces that are not sent are
+// released, if the Reader has the Release.
+func ReadChan(ctx context.Context, r Reader) <-chan Frame {
+	ch := make(chan Frame)
+	go func() {
+		defer close(ch)
+		stop := interrupt(ctx, source(r), true)
+		defer stop()
+		for {
+			piece, err := r.Read()
+			if ctx.Err() != nil {
+				releasePiece(r, piece)
+				return
+			}
+			select {
+			case ch <- Frame{Piece: piece, Err: err}:
+			case <-ctx.Done():
+				releasePiece(r, piece)
+				return
+			}
+			if err != nil && !more(r, err) {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// WriteChan writes pieces of returned channel by a
+// goroutine. Close the channel to flush the Writer, if
+// it has the Flush, and stop the goroutine. Errors are
+// sent to returned error channel, and it's closed when
+// the goroutine is done. Read the error channel until
+// it's closed. After an error that breaks the Writer,
+// pieces of the channel are dropped until it's closed.
+// The goroutine stops when given context is done, and
+// it's unblocked like a ReadChan. Unwritten pieces of
+// the channel are dropped then.
+func WriteChan(ctx context.Context, w Writer) (chan<- []byte, <-chan error) {
+	ch, ec := make(chan []byte), make(chan error)
+	go func() {
+		defer close(ec)
+		stop := interrupt(ctx, destination(w), false)
+		defer stop()
+		report := func(err error) bool {
+			select {
+			case ec <- err:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			select {
+			case piece, ok := <-ch:
+				if !ok {
+					if f, ok := w.(flusher); ok && !isBroken(w) {
+						if err := f.Flush(); err != nil {
+							report(err)
+						}
+					}
+					return
+				}
+				if isBroken(w) {
+					continue // drop the piece
+				}
+				if err := w.Write(piece); err != nil && ctx.Err() == nil {
+					if !report(err) {
+						return
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, ec
+}
@@ -0,0 +1,191 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestReadChan(t *testing.T) {
+	buf := writePieces(t, "one", "too large", "two")
+	r, _ := NewReader(buf, &Config{MaxSize: 5, SkipOversize: true})
+	var got []Frame
+	for f := range ReadChan(context.Background(), r) {
+		got = append(got, f)
+	}
+	if len(got) != 4 || string(got[0].Piece) != "one" ||
+		!errors.Is(got[1].Err, ErrSizeLimit) || string(got[2].Piece) != "two" ||
+		got[3].Err != io.EOF {
+		t.Errorf("unexpected frames: %v", got)
+	}
+}
+
+// waitClosed waits for given channel to be closed
+func waitClosed(t *testing.T, ch <-chan Frame) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("the channel is not closed")
+		}
+	}
+}
+
+func TestReadChan_cancel_conn(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	r, _ := NewReader(server, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := ReadChan(ctx, r)
+	time.Sleep(10 * time.Millisecond) // let it block
+	cancel()
+	waitClosed(t, ch)
+	// the connection is alive, and the deadline is reset
+	w, _ := NewWriter(client, nil)
+	w.Write([]byte("piece"))
+	if p, err := r.Read(); err != nil || string(p) != "piece" {
+		t.Errorf("unexpected result: %q, %v", p, err)
+	}
+}
+
+func TestReadChan_cancel_closer(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	r, _ := NewReader(pr, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := ReadChan(ctx, r)
+	cancel()
+	waitClosed(t, ch)
+}
+
+func TestWriteChan(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, &Config{MaxSize: 5, BufferSize: 1024})
+	ch, errs := WriteChan(context.Background(), w)
+	go func() {
+		for _, p := range []string{"one", "too large", "two"} {
+			ch <- []byte(p)
+		}
+		close(ch)
+	}()
+	var got []error
+	for err := range errs {
+		got = append(got, err)
+	}
+	if len(got) != 1 || got[0] != ErrSizeLimit {
+		t.Error("unexpected errors:", got)
+	}
+	if s := readStrings(t, buf); len(s) != 2 || s[0] != "one" ||
+		s[1] != "two" {
+		t.Error("unexpected pieces:", s)
+	}
+}
+
+func TestWriteChan_cancel(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	w, _ := NewWriter(pw, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, errs := WriteChan(ctx, w)
+	ch <- []byte("blocked") // nobody reads the pipe
+	cancel()
+	select {
+	case _, ok := <-errs:
+		if ok {
+			t.Error("unexpected error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the goroutine is not stopped")
+	}
+}
+
+// pieces sent after an error that breaks the Writer are dropped
+func TestWriteChan_broken(t *testing.T) {
+	w, _ := NewWriter(&limitWriter{w: io.Discard, n: 6}, nil)
+	ch, errs := WriteChan(context.Background(), w)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, p := range []string{"one", "two", "three"} {
+			ch <- []byte(p) // doesn't block
+		}
+		close(ch)
+	}()
+	var got []error
+	for err := range errs {
+		got = append(got, err)
+	}
+	<-done
+	if len(got) != 1 || w.Err() == nil {
+		t.Error("unexpected errors:", got)
+	}
+}
+
+// sliceReader is a Reader of given pieces
+type sliceReader struct {
+	pieces []string
+}
+
+func (s *sliceReader) Read() ([]byte, error) {
+	if len(s.pieces) == 0 {
+		return nil, io.EOF
+	}
+	p := s.pieces[0]
+	s.pieces = s.pieces[1:]
+	return []byte(p), nil
+}
+
+// a Reader and a Writer without other methods
+func TestReadChan_WriteChan_mock(t *testing.T) {
+	sw := new(sliceWriter)
+	ch, errs := WriteChan(context.Background(), sw)
+	for f := range ReadChan(context.Background(),
+		&sliceReader{pieces: []string{"one", "two"}}) {
+		if f.Err == nil {
+			ch <- f.Piece
+		} else if f.Err != io.EOF {
+			t.Error("unexpected error:", f.Err)
+		}
+	}
+	close(ch)
+	for err := range errs {
+		t.Error("unexpected error:", err)
+	}
+	if len(sw.pieces) != 2 || sw.pieces[0] != "one" || sw.pieces[1] != "two" {
+		t.Error("wrong pieces:", sw.pieces)
+	}
+}
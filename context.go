@@ -0,0 +1,75 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import "context"
+
+// ReadContext is the Read that returns error of given
+// context when it's done. If underlying io.Reader has
+// the SetReadDeadline method (e.g. a net.Conn), then
+// deadline of the context is set, and a canceled context
+// sets a deadline in the past. The deadline is reset
+// after that. Like a timeout, it keeps the read part of
+// a frame, and next call continues the frame. Otherwise,
+// the io.Reader is closed on cancel, if it's an io.Closer.
+// The context is also used to wait for a Budget.
+func (r *reader) ReadContext(ctx context.Context) (piece []byte, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	defer func(c context.Context) { r.ctx = c }(r.ctx)
+	r.ctx = ctx
+	stop := interrupt(ctx, r.src, true)
+	piece, err = r.Read()
+	if stop() && err != nil {
+		err = ctx.Err()
+	}
+	return piece, ctxErr(ctx, err)
+}
+
+// WriteContext is the Write that returns error of given
+// context when it's done. It uses the SetWriteDeadline
+// like the ReadContext uses the SetReadDeadline, and the
+// Writer keeps unwritten rest of a frame like after a
+// timeout. Otherwise, underlying io.Writer is closed on
+// cancel, if it's an io.Closer.
+func (w *writer) WriteContext(ctx context.Context, piece []byte) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	stop := interrupt(ctx, w.dst, false)
+	err = w.Write(piece)
+	if stop() && err != nil {
+		err = ctx.Err()
+	}
+	return ctxErr(ctx, err)
+}
+
+func (s *syncWriter) WriteContext(ctx context.Context, piece []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.WriteContext(ctx, piece)
+}
@@ -0,0 +1,125 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestReader_ReadContext(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	r, _ := NewReader(server, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := r.ReadContext(ctx); err != context.Canceled {
+		t.Fatal("wrong error, want context.Canceled, got:", err)
+	}
+	if _, err := r.ReadContext(ctx); err != context.Canceled {
+		t.Fatal("wrong error, want context.Canceled, got:", err)
+	}
+	// a part of a frame
+	buf := writePieces(t, "piece")
+	client.Write(buf.Next(2))
+	ctx, cancel = context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	if _, err := r.ReadContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal("wrong error, want context.DeadlineExceeded, got:", err)
+	}
+	client.Write(buf.Bytes())
+	p, err := r.ReadContext(context.Background())
+	if err != nil || string(p) != "piece" {
+		t.Errorf("unexpected result: %q, %v", p, err)
+	}
+}
+
+func TestReader_ReadContext_closer(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	r, _ := NewReader(pr, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := r.ReadContext(ctx); err != context.Canceled {
+		t.Fatal("wrong error, want context.Canceled, got:", err)
+	}
+	if _, err := pw.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Error("the pipe is not closed:", err)
+	}
+}
+
+func TestWriter_WriteContext(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	piece := bytes.Repeat([]byte("0123456789abcdef"), 1<<20)
+	c := &Config{MaxSize: 2 * len(piece), Checksum: true}
+	w, _ := NewSyncWriter(client, c)
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	// nobody reads
+	if err := w.WriteContext(ctx, piece); err != context.DeadlineExceeded {
+		t.Fatal("wrong error, want context.DeadlineExceeded, got:", err)
+	}
+	done := make(chan error)
+	go func() {
+		r, _ := NewReader(server, c)
+		p, err := r.Read()
+		if err == nil && !bytes.Equal(p, piece) {
+			err = ErrChecksum
+		}
+		done <- err
+	}()
+	// write rest of the frame
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriter_WriteContext_closer(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	w, _ := NewWriter(pw, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := w.WriteContext(ctx, []byte("x")); err != context.Canceled {
+		t.Fatal("wrong error, want context.Canceled, got:", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := w.WriteContext(ctx, []byte("x")); err != context.Canceled {
+		t.Fatal("wrong error, want context.Canceled, got:", err)
+	}
+}
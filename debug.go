@@ -0,0 +1,121 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"unsafe"
+)
+
+// poison fills pieces put to a DebugPool
+const poison = 0xde
+
+// debugMax is number of recently put pieces
+// remembered by a DebugPool
+const debugMax = 1024
+
+// debugPut is a piece in a DebugPool
+type debugPut struct {
+	stack []byte // stack of the Put
+	i     int    // index in the recent
+}
+
+// debugPool is a Pool wrapper that checks usage of pieces
+type debugPool struct {
+	inner  Pool
+	mu     sync.Mutex
+	put    map[*byte]debugPut // pieces in the pool
+	recent [debugMax]*byte    // ring of put pieces
+	n      int                // next index of the recent
+}
+
+// DebugPool wraps given Pool. The wrapper panics with
+// stack traces if a Get returns a piece with wrong
+// length, if a piece is put twice, or if a piece is
+// modified after Put. It fills pieces by 0xde on Put.
+// It's slow and it holds memory of last 1024 put
+// pieces, older pieces are not checked. Use it for
+// tests and staging only.
+func DebugPool(inner Pool) Pool {
+	return &debugPool{inner: inner, put: make(map[*byte]debugPut)}
+}
+
+// Get calls Get of the inner Pool and checks the piece.
+func (d *debugPool) Get(size int) (piece []byte) {
+	piece = d.inner.Get(size)
+	if len(piece) != size {
+		panic(fmt.Sprintf("lend: Pool.Get(%d) returned %d bytes, at:\n%s",
+			size, len(piece), debug.Stack()))
+	}
+	if cap(piece) == 0 {
+		return
+	}
+	full := piece[:cap(piece)]
+	p := unsafe.SliceData(full)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dp, ok := d.put[p]
+	if !ok {
+		return // a new or forgotten piece
+	}
+	delete(d.put, p)
+	d.recent[dp.i] = nil
+	for _, b := range full {
+		if b != poison {
+			panic(fmt.Sprintf("lend: piece %p is modified after Put, put"+
+				" at:\n%s", p, dp.stack))
+		}
+	}
+	return
+}
+
+// Put poisons given piece and puts it to the inner Pool.
+func (d *debugPool) Put(piece []byte) {
+	if cap(piece) == 0 {
+		d.inner.Put(piece)
+		return
+	}
+	full := piece[:cap(piece)]
+	p := unsafe.SliceData(full)
+	d.mu.Lock()
+	if dp, ok := d.put[p]; ok {
+		d.mu.Unlock()
+		panic(fmt.Sprintf("lend: piece %p is put twice, first Put at:\n%s"+
+			"\nsecond Put at:\n%s", p, dp.stack, debug.Stack()))
+	}
+	if old := d.recent[d.n]; old != nil {
+		delete(d.put, old) // forget oldest piece
+	}
+	d.recent[d.n], d.put[p] = p, debugPut{debug.Stack(), d.n}
+	d.n = (d.n + 1) % debugMax
+	d.mu.Unlock()
+	for i := range full {
+		full[i] = poison
+	}
+	d.inner.Put(piece)
+}
@@ -0,0 +1,131 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"testing"
+)
+
+// stackPool returns last put piece
+type stackPool struct {
+	pieces [][]byte
+	short  bool // return short pieces
+}
+
+func (s *stackPool) Get(size int) []byte {
+	if s.short {
+		size--
+	}
+	if n := len(s.pieces); n > 0 && cap(s.pieces[n-1]) >= size {
+		piece := s.pieces[n-1]
+		s.pieces = s.pieces[:n-1]
+		return piece[:size]
+	}
+	return make([]byte, size)
+}
+
+func (s *stackPool) Put(piece []byte) {
+	s.pieces = append(s.pieces, piece)
+}
+
+func TestDebugPool_Get(t *testing.T) {
+	p := DebugPool(&stackPool{})
+	piece := p.Get(10)
+	if len(piece) != 10 {
+		t.Fatal("wrong length:", len(piece))
+	}
+	p.Put(piece)
+	for _, b := range piece {
+		if b != poison {
+			t.Fatal("not poisoned")
+		}
+	}
+	if got := p.Get(5); cap(got) != 10 {
+		t.Error("piece is not reused")
+	}
+	mustPanic(t, "returned 9 bytes", func() {
+		DebugPool(&stackPool{short: true}).Get(10)
+	})
+}
+
+func TestDebugPool_double_put(t *testing.T) {
+	p := DebugPool(&stackPool{})
+	piece := p.Get(10)
+	p.Put(piece)
+	mustPanic(t, "second Put at", func() { p.Put(piece[:2]) })
+}
+
+func TestDebugPool_use_after_put(t *testing.T) {
+	p := DebugPool(&stackPool{})
+	piece := p.Get(10)
+	p.Put(piece)
+	piece[9] = 1
+	mustPanic(t, "modified after Put", func() { p.Get(10) })
+}
+
+func TestDebugPool_lend(t *testing.T) {
+	p := DebugPool(NewBucketPool(16, 1024))
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, &Config{MaxSize: 100, Pool: p})
+	r, _ := NewReader(&buf, &Config{MaxSize: 100, Pool: p,
+		Incremental: true})
+	for _, s := range []string{"one", "two", "three"} {
+		piece := p.Get(len(s))
+		copy(piece, s)
+		if err := w.Write(piece); err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != s {
+			t.Errorf("want %q, got %q", s, got)
+		}
+		r.Release(got)
+	}
+}
+
+func TestDebugPool_bounded(t *testing.T) {
+	p := DebugPool(dummyPool{}).(*debugPool)
+	for i := 0; i < 3*debugMax; i++ {
+		p.Put(make([]byte, 1)) // dropped by the inner Pool
+	}
+	if len(p.put) != debugMax {
+		t.Errorf("wrong remembered pieces, want %d, got %d", debugMax,
+			len(p.put))
+	}
+	// a piece got back frees its slot
+	piece := make([]byte, 1)
+	p.Put(piece)
+	p.inner = constPool(piece)
+	p.Get(1)
+	if len(p.put) != debugMax-1 {
+		t.Error("the piece is not forgotten:", len(p.put))
+	}
+	mustPanic(t, "second Put at", func() { p.Put(piece); p.Put(piece) })
+}
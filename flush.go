@@ -0,0 +1,156 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// flushWriter is buffer of a Writer; the buffer is
+// flushed when it's full, by the Flush, or by the timer
+type flushWriter struct {
+	w        io.Writer
+	mu       sync.Mutex
+	buf      []byte
+	interval time.Duration // the FlushInterval
+	timer    *time.Timer
+	armed    bool // the timer is started
+	closed   bool
+}
+
+func newFlushWriter(w io.Writer, size int, d time.Duration) *flushWriter {
+	return &flushWriter{
+		w:        w,
+		buf:      make([]byte, 0, size),
+		interval: d,
+	}
+}
+
+// flush writes the buffer; unwritten rest of the buffer
+// is kept on errors, thus frames are never cut
+func (f *flushWriter) flush() (err error) {
+	var n int
+	for len(f.buf) > 0 {
+		if n, err = f.w.Write(f.buf); err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		f.buf = f.buf[:copy(f.buf, f.buf[n:])]
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Write buffers given frame, or writes it directly,
+// if it's larger than the buffer
+func (f *flushWriter) Write(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(f.buf)+len(p) > cap(f.buf) {
+		if err = f.flush(); err != nil {
+			return
+		}
+		if len(p) >= cap(f.buf) {
+			return f.w.Write(p)
+		}
+	}
+	f.buf = append(f.buf, p...)
+	if f.interval > 0 && !f.armed {
+		f.arm()
+	}
+	return len(p), nil
+}
+
+// arm starts the timer
+func (f *flushWriter) arm() {
+	if f.timer == nil {
+		f.timer = time.AfterFunc(f.interval, f.tick)
+	} else {
+		f.timer.Reset(f.interval)
+	}
+	f.armed = true
+}
+
+// tick flushes the buffer by the timer; after a timeout
+// it tries again, other errors are returned by next
+// Write or Flush
+func (f *flushWriter) tick() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.armed = false
+	if f.closed {
+		return
+	}
+	if err := f.flush(); isTimeout(err) {
+		f.arm()
+	}
+}
+
+// Flush writes buffered frames.
+func (f *flushWriter) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flush()
+}
+
+// Close stops the timer and flushes buffered frames.
+func (f *flushWriter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed = true; f.timer != nil {
+		f.timer.Stop()
+		f.armed = false
+	}
+	return f.flush()
+}
+
+// Flush writes rest of a frame kept after a timeout and
+// buffered frames to underlying io.Writer. Unwritten
+// frames are kept on errors. Call it again after a
+// timeout.
+func (w *writer) Flush() (err error) {
+	if err = w.pending(); err != nil || w.buf == nil {
+		return
+	}
+	return w.buf.Flush()
+}
+
+// Close flushes the Writer and stops the timer of the
+// FlushInterval. Next writes return io.ErrClosedPipe, if
+// the BufferSize option is set. It doesn't close
+// underlying io.Writer.
+func (w *writer) Close() (err error) {
+	if err = w.pending(); err != nil || w.buf == nil {
+		return
+	}
+	return w.buf.Close()
+}
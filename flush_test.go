@@ -0,0 +1,165 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfig_Check_buffer(t *testing.T) {
+	for _, c := range []*Config{
+		{MaxSize: 100, BufferSize: -1},
+		{MaxSize: 100, BufferSize: 100, FlushInterval: -1},
+		{MaxSize: 100, FlushInterval: time.Second},
+	} {
+		if c.Check() == nil {
+			t.Error("missing error:", c.BufferSize, c.FlushInterval)
+		}
+	}
+}
+
+func TestWriter_buffer(t *testing.T) {
+	buf := new(bytes.Buffer)
+	cw := &countWriter{w: buf}
+	c := &Config{MaxSize: 1000, BufferSize: 32}
+	w, err := NewWriter(cw, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("one"))
+	w.Write([]byte("two"))
+	if cw.writes != 0 {
+		t.Error("frames are not buffered")
+	}
+	w.Write(bytes.Repeat([]byte("x"), 20)) // the buffer is full
+	if cw.writes != 1 || buf.Len() != 14 {
+		t.Error("the buffer is not flushed:", cw.writes, buf.Len())
+	}
+	w.Write(bytes.Repeat([]byte("y"), 100)) // larger than the buffer
+	if cw.writes != 3 {
+		t.Error("wrong number of writes:", cw.writes)
+	}
+	w.Write([]byte("three"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := NewReader(buf, c)
+	for _, want := range []string{"one", "two", string(bytes.Repeat(
+		[]byte("x"), 20)), string(bytes.Repeat([]byte("y"), 100)), "three"} {
+		if p, err := r.Read(); err != nil || string(p) != want {
+			t.Errorf("unexpected result: %q, %v", p, err)
+		}
+	}
+}
+
+func TestWriter_buffer_timeout(t *testing.T) {
+	buf := new(bytes.Buffer)
+	c := &Config{MaxSize: 100, BufferSize: 16, Checksum: true}
+	w, _ := NewWriter(&timeoutWriter{w: buf}, c)
+	pieces := []string{"one", "two", "three", "four"}
+	for _, s := range pieces {
+		for err := w.Write([]byte(s)); err != nil; err = w.Flush() {
+			if !isTimeout(err) {
+				t.Fatal(err)
+			}
+		}
+	}
+	for err := w.Flush(); err != nil; err = w.Flush() {
+		if !isTimeout(err) {
+			t.Fatal(err)
+		}
+	}
+	r, _ := NewReader(buf, c)
+	for _, want := range pieces {
+		if p, err := r.Read(); err != nil || string(p) != want {
+			t.Errorf("unexpected result: %q, %v", p, err)
+		}
+	}
+}
+
+// syncBuffer is bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Len()
+}
+
+func TestWriter_flush_interval(t *testing.T) {
+	buf := new(syncBuffer)
+	w, _ := NewWriter(buf, &Config{MaxSize: 100, BufferSize: 1024,
+		FlushInterval: 10 * time.Millisecond})
+	defer w.Close()
+	for i := 0; i < 2; i++ {
+		w.Write([]byte("piece"))
+		deadline := time.Now().Add(5 * time.Second)
+		for buf.Len() != 9*(i+1) {
+			if time.Now().After(deadline) {
+				t.Fatal("the buffer is not flushed by the timer")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestWriter_Close(t *testing.T) {
+	buf := new(syncBuffer)
+	w, _ := NewWriter(buf, &Config{MaxSize: 100, BufferSize: 1024,
+		FlushInterval: time.Hour})
+	w.Write([]byte("piece"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 9 {
+		t.Error("the buffer is not flushed")
+	}
+	if err := w.Write([]byte("piece")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Error("wrong error, want io.ErrClosedPipe, got:", err)
+	}
+	if w.Err() != nil {
+		t.Error("the Writer is broken:", w.Err())
+	}
+	// unbuffered
+	w, _ = NewWriter(buf, nil)
+	if w.Flush() != nil || w.Close() != nil {
+		t.Error("unexpected error")
+	}
+}
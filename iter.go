@@ -0,0 +1,63 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"io"
+	"iter"
+)
+
+// All returns an iterator over pieces of given Reader.
+// A clean io.EOF ends the iteration. Other errors are
+// yielded, and the iteration ends, if the Reader can't
+// continue (e.g. a truncated frame). Release pieces when
+// they are no longer used, if the Reader has the Release.
+func All(r Reader) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		for {
+			piece, err := r.Read()
+			if err == io.EOF {
+				return
+			}
+			if !yield(piece, err) || err != nil && !more(r, err) {
+				return
+			}
+		}
+	}
+}
+
+// Frames returns an iterator over pieces of given io.Reader.
+// It's All of a Reader created by NewReader. An error of
+// the Config is yielded.
+func Frames(r io.Reader, c *Config) iter.Seq2[[]byte, error] {
+	lr, err := NewReader(r, c)
+	if err != nil {
+		return func(yield func([]byte, error) bool) {
+			yield(nil, err)
+		}
+	}
+	return All(lr)
+}
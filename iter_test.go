@@ -0,0 +1,105 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestAll(t *testing.T) {
+	buf := writePieces(t, "one", "too large", "two")
+	r, _ := NewReader(buf, &Config{MaxSize: 5, SkipOversize: true})
+	var pieces []string
+	var errs []error
+	for piece, err := range All(r) {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		pieces = append(pieces, string(piece))
+	}
+	if len(pieces) != 2 || pieces[0] != "one" || pieces[1] != "two" {
+		t.Error("unexpected pieces:", pieces)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrSizeLimit) {
+		t.Error("unexpected errors:", errs)
+	}
+}
+
+func TestAll_break(t *testing.T) {
+	r, _ := NewReader(writePieces(t, "one", "two"), nil)
+	for range All(r) {
+		break
+	}
+	if p, err := r.Read(); err != nil || string(p) != "two" {
+		t.Errorf("unexpected result: %q, %v", p, err)
+	}
+}
+
+// a Reader without other methods
+func TestAll_mock(t *testing.T) {
+	var pieces []string
+	for piece, err := range All(&sliceReader{pieces: []string{"one", "two"}}) {
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		pieces = append(pieces, string(piece))
+	}
+	if len(pieces) != 2 || pieces[0] != "one" || pieces[1] != "two" {
+		t.Error("unexpected pieces:", pieces)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	buf := writePieces(t, "one", "two")
+	buf.Truncate(buf.Len() - 1)
+	var pieces []string
+	var errs []error
+	for piece, err := range Frames(buf, nil) {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		pieces = append(pieces, string(piece))
+	}
+	if len(pieces) != 1 || pieces[0] != "one" {
+		t.Error("unexpected pieces:", pieces)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], io.ErrUnexpectedEOF) {
+		t.Error("unexpected errors:", errs)
+	}
+	var n int
+	for _, err := range Frames(buf, &Config{}) {
+		if n++; err == nil {
+			t.Error("missing error")
+		}
+	}
+	if n != 1 {
+		t.Error("the error is not yielded")
+	}
+}
@@ -24,22 +24,31 @@
 //
 
 // Package lend implements length-delimited reader and writer. It also
-// includes some framing mechanism for UDP network. It's possible to
-// use a fixed-size length and a varint encoded length. The lend allows
-// to use very large pieces of data, but if length of a piece is greater
-// than max positive int32, then it's impossible to read/write it on 32-bit
-// platforms. The framing mechanism uses user-provided delimiter that
-// points to start of a piece of data. It's possible to limit max size
-// of pieces. But if you uses a fixed-size length then for limit less
-// than max positive int32, 4 bytes is used to keep the length. If limit
-// is greater, then 8 bytes is used. The package is smiple and well-tested.
+// includes some framing mechanism for lossy streams and a reader and a
+// writer for datagram networks like UDP (one piece per datagram). It's
+// possible to use a fixed-size length and a varint encoded length. The
+// lend allows to use very large pieces of data, but if length of a
+// piece is greater than max positive int32, then it's impossible to
+// read/write it on 32-bit platforms. The framing mechanism uses
+// user-provided delimiter that points to start of a piece of data. It's
+// possible to limit max size of pieces. But if you uses a fixed-size
+// length then for limit less than max positive int32, 4 bytes is used
+// to keep the length. If limit is greater, then 8 bytes is used. The
+// package is smiple and well-tested.
 package lend
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"net"
+	"time"
 )
 
 // A Pool represents a pool interface. There are not
@@ -48,7 +57,10 @@ import (
 // drop slices. If your project can cause a lot of
 // pressure on GC, then you can provide your own pool
 // (sync.Pool wrapper or another) that will be used
-// for creating/dropping slices.
+// for creating/dropping slices. A Reader gets pieces
+// from the Pool, and puts them back by Release or
+// by itself, if a piece is not returned because of
+// an error. A Writer puts written pieces.
 type Pool interface {
 	Get(size int) []byte
 	Put([]byte)
@@ -57,11 +69,33 @@ type Pool interface {
 // A Reader represents an interface that reads
 // a data, piece by piece. Both, Reader and Writer
 // should have the same configs MaxSize,
-// Heading and Varint.
+// Heading, Varint and Checksum.
 type Reader interface {
 	Read() (piece []byte, err error)
 }
 
+// A FrameReader is a Reader created by the NewReader.
+// The NextReader returns io.Reader of next piece and
+// size of the piece. It's useful for very large pieces.
+// If an error occurs in the middle of a frame
+// and there is no Heading to find next frame,
+// then the Reader is broken. All next calls
+// return ErrBroken wrapping the error, and
+// the Err returns the error. The Release puts
+// a piece back to a Pool when it's no longer
+// used. The ReadInto and the ReadNoCopy read
+// a piece without allocations. The ReadContext
+// can be canceled by a context.
+type FrameReader interface {
+	Reader
+	ReadContext(ctx context.Context) (piece []byte, err error)
+	ReadInto(buf []byte) (n int, err error)
+	ReadNoCopy() (piece []byte, err error)
+	NextReader() (piece io.Reader, size int64, err error)
+	Err() error
+	Release(piece []byte)
+}
+
 // A Writer represents an interface that
 // writes a data, piece by piece. Don't be
 // entirely mislead. The piece argument
@@ -72,26 +106,218 @@ type Writer interface {
 	Write(piece []byte) (err error)
 }
 
+// A FrameWriter is a Writer created by the NewWriter.
+// The NextWriter returns io.WriteCloser for a piece
+// of given size. It's useful for very large pieces.
+// The Writer is broken by an error in the middle
+// of a frame, like a Reader. The WriteOwned
+// hands a piece over to the Writer, and the
+// piece is put to a Pool after writing. The
+// WriteBorrowed never puts a piece to a Pool.
+// The Write is one of them, depending on the
+// Borrowed option. The WriteBatch writes many
+// pieces at once. The WriteContext can be
+// canceled by a context. The Flush writes buffered
+// frames, if the BufferSize option is set, and
+// the Close flushes them and stops the timer
+// of the FlushInterval.
+type FrameWriter interface {
+	Writer
+	WriteContext(ctx context.Context, piece []byte) (err error)
+	WriteOwned(piece []byte) (err error)
+	WriteBorrowed(piece []byte) (err error)
+	WriteBatch(pieces [][]byte) (n int, err error)
+	Flush() (err error)
+	Close() (err error)
+	NextWriter(size int64) (piece io.WriteCloser, err error)
+	Err() error
+}
+
 const (
 	maxInt32 = int(^uint32(0) >> 1)
 	maxInt   = int(^uint(0) >> 1)
 )
 
+// incrementalChunk is initial size of a piece
+// for the Incremental option
+const incrementalChunk = 4 << 10
+
 type base struct {
-	max     int
-	pool    Pool
-	varint  bool
-	heading []byte
-	lenb    []byte // used for reading length (avoid allocs)
+	max         int
+	pool        Pool
+	budget      *Budget
+	budgetWait  bool
+	ctx         context.Context // of the ReadContext
+	varint      bool
+	incremental bool
+	checksum    bool
+	chunked     bool
+	skip        bool // skip oversize pieces
+	borrowed    bool // Write borrows pieces
+	debug       bool // check ownership of pieces
+	heading     []byte
+	lenb        []byte  // used for reading length (avoid allocs)
+	sumb        [4]byte // used for checksum
+}
+
+// castagnoli is CRC32C table used for checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func (b *base) init(c *Config) {
+	b.max = c.MaxSize
+	b.pool = c.Pool
+	b.budget = c.Budget
+	b.budgetWait = c.BudgetWait
+	b.ctx = context.Background()
+	b.varint = c.Varint
+	b.incremental = c.Incremental
+	b.checksum = c.Checksum
+	b.chunked = c.Chunked
+	b.skip = c.SkipOversize && len(c.Heading) == 0
+	b.borrowed = c.Borrowed
+	b.debug = c.DebugOwnership
+	b.heading = c.Heading
+}
+
+// sum encodes checksum of given piece
+// to the sumb and returns it
+func (b *base) sum(piece []byte) []byte {
+	binary.BigEndian.PutUint32(b.sumb[:], crc32.Checksum(piece, castagnoli))
+	return b.sumb[:]
+}
+
+// acquire n bytes from the Budget, if any
+func (b *base) acquire(n int) error {
+	if b.budget == nil || n == 0 {
+		return nil
+	}
+	if b.budgetWait {
+		return b.budget.Acquire(b.ctx, n)
+	}
+	if !b.budget.TryAcquire(n) {
+		return ErrBudgetExhausted
+	}
+	return nil
+}
+
+// release n bytes to the Budget, if any
+func (b *base) release(n int) {
+	if b.budget != nil && n != 0 {
+		b.budget.Release(n)
+	}
+}
+
+// lenSize returns max size of encoded length
+func (b *base) lenSize() int {
+	if b.varint {
+		return binary.MaxVarintLen64
+	}
+	if b.max <= maxInt32 {
+		return 4
+	}
+	return 8
+}
+
+// putLen encodes given length to the lenb
+// and returns encoded bytes
+func (b *base) putLen(l int) []byte {
+	if b.varint {
+		return b.lenb[:binary.PutVarint(b.lenb, int64(l))]
+	}
+	if b.max <= maxInt32 {
+		binary.BigEndian.PutUint32(b.lenb, uint32(l))
+	} else {
+		binary.BigEndian.PutUint64(b.lenb, uint64(l))
+	}
+	return b.lenb
+}
+
+// putChunkLen encodes length of a continuation chunk
+// (that is not last chunk of a piece) to the lenb and
+// returns encoded bytes
+func (b *base) putChunkLen(l int) []byte {
+	if b.varint {
+		return b.lenb[:binary.PutVarint(b.lenb, -int64(l))]
+	}
+	if b.max <= maxInt32 {
+		binary.BigEndian.PutUint32(b.lenb, uint32(l)|1<<31)
+	} else {
+		binary.BigEndian.PutUint64(b.lenb, uint64(l)|1<<63)
+	}
+	return b.lenb
+}
+
+// parseLen decodes and validates a length from given
+// slice; n is number of bytes used by the length
+func (b *base) parseLen(p []byte) (l, n int, err error) {
+	if b.varint {
+		var l64 int64
+		if l64, n = binary.Varint(p); n <= 0 {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		l, err = b.validateLen64(l64)
+		return
+	}
+	if n = b.lenSize(); len(p) < n {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	if n == 4 {
+		l = int(binary.BigEndian.Uint32(p))
+		err = b.validateLen(l) // uint32
+		return
+	}
+	l, err = b.validateLen64(int64(binary.BigEndian.Uint64(p)))
+	return
 }
 
 type reader struct {
-	r io.Reader
-	b io.ByteReader
+	r   io.Reader
+	b   io.ByteReader
+	src io.Reader // the underlying io.Reader
 	base
-	headbuf []byte // buffer that used to find heading
+	br   *bufio.Reader // buffer of the underlying io.Reader
+	rp   *replay       // consumed bytes to look for a heading in
+	next []int         // KMP failure function of the heading
+	// internal buffer for the ReadNoCopy and the ReadInto
+	scratch []byte
+	// state of current frame (kept on timeouts
+	// and budget errors to continue the frame)
+	stage int
+	hn    int    // matched bytes of the heading
+	hw    int    // bytes to fill a window of the heading
+	lenn  int    // read bytes of the length
+	plen  int    // unread bytes of the piece (or current chunk)
+	more  bool   // current chunk is not last
+	part  []byte // incrementally read part of the piece
+	partn int    // bytes read into the part
+	kind  int    // kind of memory of the part
+	held  int    // bytes of a Budget held for the part
+	sumn  int    // read bytes of the checksum
+	skipn int64  // bytes of current chunk to skip
+	over  bool   // the skipped piece exceeds limit of a Budget
+	lens  []byte // read bytes of lengths of the frame (Heading)
+	marks []int  // end of each length in the lens and the partn
+	dlen  int64  // declared length of the piece, -1 if not read
+	frame int64  // index of current frame
+	off   int64  // read bytes of the stream
+	// current reader returned by NextReader
+	cur *pieceReader
+	err error // error that broke the Reader
 }
 
+// stages of a frame
+const (
+	stageHeading  = iota // looking for heading
+	stageLength          // reading length
+	stagePayload         // reading payload
+	stageChecksum        // reading checksum
+	stageSkip            // skipping oversize piece
+	stageStream          // the piece is read by NextReader
+	stageDone            // the piece is read, but not returned
+)
+
 // A Config is a Reader and Writer configurations.
 // See DefaultConfig() for defaults.
 type Config struct {
@@ -117,30 +343,113 @@ type Config struct {
 	// is greater than 0, then framing mechanism
 	// is enabled. And data stream is Heading+length
 	// delimited. This option makes sence only for
-	// UDP and other protocols that can loose data.
+	// streams that can loose data. A PacketReader
+	// only checks that a datagram starts with it.
 	// This way, a Reader firstly finds a Heading.
 	// Also, this way, the ErrSizeLimit and
 	// ErrNegativeLength will never have.
 	// All this errors will be treated as
-	// wrong position and a frame will be skipped
+	// wrong position and a frame will be skipped,
+	// and the Reader looks for next Heading from
+	// second byte of the skipped one. This way,
+	// frames inside the skipped one are not lost.
 	Heading []byte
 	// Varint enables Varint encoding. By default,
 	// if MaxSize is <= max int32 then a 4 bytes
 	// are used to keep a length of a piece. If
 	// MaxSize is greater than max int32 then
 	// 8 bytes are used. This options allows to use
-	// Varint encoding. This way, an io.Reader will
-	// be converted to io.ByteReader. If it's not a
-	// io.ByteReader then "bufio" package will be
-	// used.
+	// Varint encoding.
 	Varint bool
+	// Incremental enables incremental allocation
+	// for a Reader. By default, a Reader allocates
+	// (or gets from a Pool) entire piece just after
+	// reading its length. Thus, a peer can send
+	// a few bytes of a length and make the Reader
+	// allocate MaxSize bytes. This option makes
+	// the Reader allocate 4KiB first and double
+	// the piece when it's filled up (putting
+	// previous one back to a Pool). This way,
+	// memory used by a piece is proportional to
+	// really received data. A Writer ignores it.
+	Incremental bool
+	// Checksum enables CRC32C (Castagnoli) checksum
+	// trailer. A Writer writes 4 bytes of checksum
+	// after each piece, and a Reader verifies it. If
+	// a checksum doesn't match, then a Reader returns
+	// ErrChecksum (the Reader is not broken). If a
+	// Heading is used, then such frames will be
+	// skipped like frames with wrong length. Both,
+	// Reader and Writer must have the same Checksum.
+	Checksum bool
+	// Chunked enables chunked pieces. It allows to
+	// write a piece of unknown length using
+	// NextWriter(-1). Such piece is written as
+	// a sequence of chunks. Each chunk has a length
+	// with highest bit set (negative for Varint).
+	// Last chunk has a regular length. A Heading and
+	// a checksum are written once per piece. A Reader
+	// reassembles such pieces transparently, and the
+	// MaxSize limits entire piece. Pieces written
+	// by Write are regular. A Reader without the
+	// Chunked treats chunks as ErrNegativeLength or
+	// ErrSizeLimit.
+	Chunked bool
+	// SkipOversize makes a Reader without a Heading
+	// skip pieces that exceed the MaxSize. By default,
+	// the ErrSizeLimit breaks such Reader, because
+	// the piece is not read. This option makes the
+	// Reader discard the piece without allocations
+	// and return *SizeLimitError. After that, next
+	// Read reads next piece. A Reader with a Heading
+	// skips such pieces anyway, and ignores it.
+	SkipOversize bool
+	// Budget limits total size of pieces held by all
+	// Readers that share it. A Reader acquires length
+	// of a piece (or part of it if the Incremental
+	// is set) before allocation. Use Release of the
+	// Reader when a piece is no longer used. A piece
+	// larger than limit of the Budget is skipped, and
+	// the Read returns ErrBudgetLimit. By default it's
+	// nil and there is no limit. A Writer ignores it.
+	Budget *Budget
+	// BudgetWait makes a Reader wait for room in the
+	// Budget. By default, a Reader returns the
+	// ErrBudgetExhausted. In both cases, the Reader is
+	// not broken, and next Read continues the piece.
+	// Use the ReadContext to stop waiting. A waiting
+	// Reader doesn't hold a part of a piece in the
+	// Budget, otherwise Readers could hold all the
+	// Budget waiting for each other.
+	BudgetWait bool
+	// Borrowed makes Write of a Writer and WriteTo of
+	// a PacketWriter borrow given pieces. This way, a
+	// piece is never put to a Pool, and it can be used
+	// after writing. By default pieces are owned: they
+	// are put to a Pool after writing. A sub-slice of
+	// a larger buffer or a constant must be borrowed.
+	Borrowed bool
+	// DebugOwnership makes a Writer remember recently
+	// borrowed pieces, and makes a Reader and a Writer
+	// panic if memory of such piece is put to a Pool
+	// or got from it. It's slow, use it in tests.
+	DebugOwnership bool
+	// BufferSize enables buffering of a Writer. Frames
+	// are kept in a buffer of this size until it's full,
+	// or until the Flush is called. Frames larger than
+	// the buffer are written directly.
+	BufferSize int
+	// FlushInterval is max time a frame is kept in the
+	// buffer of a Writer. A background timer flushes
+	// the buffer after that. It requires the BufferSize.
+	FlushInterval time.Duration
 }
 
 // DefaultConfig returns default configurations.
 // This used if *Config provided to a NewReader
 // or a NewWriter is nil. By default MaxSize is
-// max int32, Pool is nil, Heading is nil and
-// Varint is false.
+// max int32, Pool is nil, Heading is nil,
+// Varint and Incremental are false.
 func DefaultConfig() *Config {
 	return &Config{
 		MaxSize: maxInt32,
@@ -149,18 +458,25 @@ func DefaultConfig() *Config {
 
 // Check validates configurations.
 func (c *Config) Check() (err error) {
-	if c.MaxSize <= 0 {
+	switch {
+	case c.MaxSize <= 0:
 		err = errors.New("(*Config).MaxSize is negative or zero")
+	case c.BufferSize < 0:
+		err = errors.New("(*Config).BufferSize is negative")
+	case c.FlushInterval < 0:
+		err = errors.New("(*Config).FlushInterval is negative")
+	case c.FlushInterval > 0 && c.BufferSize == 0:
+		err = errors.New("(*Config).FlushInterval requires BufferSize")
 	}
 	return
 }
 
-// NewReader creates Reader interface over given
+// NewReader creates FrameReader interface over given
 // io.Reader using given *Config. If *Config
 // is nil then DefaultConfig() is used. If given
 // io.Reader is nil then first Read causes panic.
 // Error indicates that *Config is incorrect
-func NewReader(r io.Reader, c *Config) (Reader, error) {
+func NewReader(r io.Reader, c *Config) (FrameReader, error) {
 	if c == nil {
 		c = DefaultConfig()
 	}
@@ -168,100 +484,196 @@ func NewReader(r io.Reader, c *Config) (Reader, error) {
 		return nil, err
 	}
 	q := new(reader)
-	q.r = r
-	q.max = int(c.MaxSize)
-	q.pool = c.Pool
-	q.varint = c.Varint
-	q.heading = c.Heading
-	if q.varint {
-		q.makeByteReader()
-	} else if c.MaxSize > maxInt32 {
-		q.lenb = make([]byte, 8)
-	} else {
-		q.lenb = make([]byte, 4)
-	}
+	q.r, q.src = r, r
+	q.dlen = -1
+	q.init(c)
+	q.makeBufReader()
 	if len(q.heading) > 0 {
-		q.headbuf = make([]byte, len(q.heading))
+		q.next = kmp(q.heading)
 	}
+	q.lenb = make([]byte, q.lenSize())
 	return q, nil
 }
 
-func (r *reader) makeByteReader() {
-	if br, ok := r.r.(io.ByteReader); ok {
-		r.b = br
-		return
-	}
+// makeBufReader wraps underlying io.Reader with
+// bufio.Reader; it batches reads of lengths and
+// payloads, and it's used to find heading
+func (r *reader) makeBufReader() {
 	br := bufio.NewReader(r.r)
+	r.br = br
 	r.b = br
 	r.r = br
 }
 
-func (r *reader) get(size int) []byte {
-	if r.pool != nil {
-		return r.pool.Get(size)
+func (b *base) get(size int) []byte {
+	if b.pool != nil {
+		piece := b.pool.Get(size)
+		if b.debug {
+			borrowed.check(piece)
+		}
+		return piece
 	}
 	return make([]byte, size)
 }
 
-// [asdf]
-// [asaf]
-//  01 - reset
-//    2 - reset
-//
-// [aasd]
-//  0 - reset
-//   123 - got it
-
-// x = 0
-// n = x
-// find n symbol from heading into hb, as m
-// n++
-// find n symbol from heading into hb
-//  - got it: retry
-//  - not found, x++, retry all
-// finally
-// m is a position of first symbol (from heading) that
-// starts the sequance.
-//   - move it to beginning
-//   - read remainder
-// retry all (inclusive cmp)
-
-// len(hs) == len(ts)
-func look(hs, ts []byte) (n int) {
-startPos:
-	for ; n < len(hs); n++ {
-		var i, j int = n, 0
-		for ; i < len(hs); i++ {
-			if hs[j] == ts[i] {
-				j++
-				continue
-			}
-			continue startPos
-		}
+// Release puts given piece, returned by Read, back
+// to a Pool and releases it in a Budget. Don't use
+// the piece after that. It's safe to release nil.
+func (b *base) Release(piece []byte) {
+	if piece == nil {
 		return
 	}
-	return // call look(nil, nil) for 100% coverage
+	b.release(len(piece))
+	b.put(piece)
+}
+
+// kmp returns KMP failure function of given heading,
+// next[i] is length of the longest proper prefix of
+// heading[:i+1] that is also its suffix
+func kmp(heading []byte) (next []int) {
+	next = make([]int, len(heading))
+	for i, k := 1, 0; i < len(heading); i++ {
+		for k > 0 && heading[i] != heading[k] {
+			k = next[k-1]
+		}
+		if heading[i] == heading[k] {
+			k++
+		}
+		next[i] = k
+	}
+	return
 }
 
+// findHeading reads and discards data up to and
+// including a heading; it scans buffered data
+// in linear time using the KMP failure function
+// and keeps number of matched bytes between calls
 func (r *reader) findHeading() (err error) {
+	var chunk []byte
 	for {
-		var n int
-		if _, err = io.ReadFull(r.r, r.headbuf); err != nil {
-			return
-		}
-	lookAgain:
-		if n = look(r.heading, r.headbuf); n == 0 { // got it!
+		r.unwrap()
+		if _, err = r.br.Peek(1); err != nil {
+			if err == io.EOF && r.hw > 0 {
+				err = io.ErrUnexpectedEOF
+			}
 			return
 		}
-		if n == len(r.heading) { // not found
-			continue
+		chunk, _ = r.br.Peek(r.br.Buffered())
+		for i := 0; i < len(chunk); i++ {
+			if r.hn == 0 {
+				// fast skip to first byte of the heading
+				j := bytes.IndexByte(chunk[i:], r.heading[0])
+				if j < 0 {
+					r.window(len(chunk) - i)
+					break
+				}
+				r.window(j)
+				i += j
+			}
+			if r.hw == 0 {
+				r.hw = len(r.heading) - r.hn
+			}
+			r.hw--
+			for r.hn > 0 && chunk[i] != r.heading[r.hn] {
+				r.hn = r.next[r.hn-1]
+			}
+			if chunk[i] == r.heading[r.hn] {
+				r.hn++
+			}
+			if r.hn == len(r.heading) { // got it!
+				r.hn, r.hw = 0, 0
+				r.br.Discard(i + 1)
+				r.off += int64(i + 1)
+				return
+			}
 		}
-		// partially read
-		copy(r.headbuf, r.headbuf[n:])
-		if _, err = io.ReadFull(r.r, r.headbuf[len(r.headbuf)-n:]); err != nil {
-			return
+		r.br.Discard(len(chunk))
+		r.off += int64(len(chunk))
+	}
+}
+
+// window counts n skipped bytes that don't match the
+// heading; the heading was looked for in windows of
+// its length, and EOF in the middle of a window is
+// io.ErrUnexpectedEOF, the window keeps this result
+func (r *reader) window(n int) {
+	if n <= r.hw {
+		r.hw -= n
+		return
+	}
+	if n -= r.hw; n%len(r.heading) == 0 {
+		r.hw = 0
+		return
+	}
+	r.hw = len(r.heading) - n%len(r.heading)
+}
+
+// A replay is consumed bytes of a frame followed by
+// the buffered io.Reader; a false heading can be found
+// inside a payload, and real frames can start after it
+type replay struct {
+	b []byte        // unread consumed bytes
+	r *bufio.Reader // the buffer of the io.Reader
+}
+
+func (p *replay) Read(b []byte) (n int, err error) {
+	if len(p.b) == 0 {
+		return p.r.Read(b)
+	}
+	n = copy(b, p.b)
+	p.b = p.b[n:]
+	return
+}
+
+// mark keeps read bytes of a length of the frame
+// for the rescan, if the Heading is set
+func (r *reader) mark() {
+	if len(r.heading) > 0 {
+		r.lens = append(r.lens, r.lenb[:r.lenn]...)
+		r.marks = append(r.marks, len(r.lens), r.partn)
+	}
+}
+
+// rescan makes the Reader look for a heading again
+// starting from second byte of the heading of current
+// frame; it's called when the frame is dropped, and
+// its read bytes are replayed before the buffer; a
+// skipped piece and a piece of a NextReader are not
+// kept, thus they are not replayed
+func (r *reader) rescan() {
+	if len(r.heading) == 0 || r.stage == stageHeading ||
+		r.stage == stageSkip || r.stage == stageStream {
+		return
+	}
+	b := append([]byte{}, r.heading[1:]...)
+	for i, start := 0, 0; i < len(r.marks); i += 2 {
+		end := r.partn
+		if i+3 < len(r.marks) {
+			end = r.marks[i+3]
 		}
-		goto lookAgain
+		b = append(b, r.lens[start:r.marks[i]]...)
+		b = append(b, r.part[r.marks[i+1]:end]...)
+		start = r.marks[i]
+	}
+	b = append(b, r.lenb[:r.lenn]...)
+	b = append(b, r.sumb[:r.sumn]...)
+	r.off -= int64(len(b))
+	under := r.br
+	if r.rp != nil { // rescan of a replay
+		buf, _ := r.br.Peek(r.br.Buffered())
+		b = append(append(b, buf...), r.rp.b...)
+		under = r.rp.r
+	}
+	r.rp = &replay{b: b, r: under}
+	r.br = bufio.NewReaderSize(r.rp, under.Size())
+	r.b, r.r = r.br, r.br
+}
+
+// unwrap drops read replay
+func (r *reader) unwrap() {
+	if r.rp != nil && len(r.rp.b) == 0 && r.br.Buffered() == 0 {
+		r.br = r.rp.r
+		r.b, r.r, r.rp = r.br, r.br, nil
 	}
 }
 
@@ -270,25 +682,108 @@ var (
 	ErrNegativeLength = errors.New("negative length")
 	// ErrSizeLimit means a length of a piece of data exceeds MaxSize option.
 	ErrSizeLimit = errors.New("size limit exceeded")
+	// ErrChecksum means a checksum of a piece of data doesn't match.
+	ErrChecksum = errors.New("checksum mismatch")
+	// ErrBroken means a Reader or a Writer is broken by an error
+	// in the middle of a frame. Use Err method to get the error.
+	ErrBroken = errors.New("broken stream")
+	// ErrPending means a piece is not written, because rest of
+	// previous frame, kept after a timeout, is not written yet.
+	ErrPending = errors.New("previous frame is pending")
+)
+
+// broken wraps error that broke a Reader or a Writer
+func broken(err error) error {
+	return fmt.Errorf("%w: %w", ErrBroken, err)
+}
+
+// pending wraps error of a pending frame
+func pending(err error) error {
+	return fmt.Errorf("%w: %w", ErrPending, err)
+}
+
+// A SizeLimitError is returned by a Reader with the
+// SkipOversize option when a piece exceeds MaxSize.
+// The piece is skipped, and the Reader continues
+// from next piece. The SizeLimitError is the
+// ErrSizeLimit for errors.Is.
+type SizeLimitError struct {
+	Size    int64 // declared size of the piece
+	MaxSize int   // the MaxSize option
+}
+
+// Error implements error interface.
+func (s *SizeLimitError) Error() string {
+	return fmt.Sprintf("%s: piece of %d bytes skipped (limit %d)",
+		ErrSizeLimit.Error(), s.Size, s.MaxSize)
+}
+
+// Is reports whether given error is the ErrSizeLimit.
+func (s *SizeLimitError) Is(err error) bool {
+	return err == ErrSizeLimit
+}
+
+// A Stage is a part of a frame.
+type Stage int
+
+// stages of a frame
+const (
+	StageHeading  Stage = iota // looking for a Heading
+	StageLength                // reading a length
+	StagePayload               // reading a piece
+	StageChecksum              // reading a checksum
 )
 
+var stageNames = [...]string{"heading", "length", "payload", "checksum"}
+
+// String implements fmt.Stringer interface.
+func (s Stage) String() string {
+	if s < 0 || int(s) >= len(stageNames) {
+		return fmt.Sprintf("Stage(%d)", int(s))
+	}
+	return stageNames[s]
+}
+
+// A FrameError describes where a Reader fails. Use
+// errors.Is and errors.As to check underlying error.
+// A clean io.EOF, timeouts, the ErrBudgetExhausted
+// and errors of a context are never wrapped.
+type FrameError struct {
+	Frame  int64 // index of the frame, starting from 0
+	Offset int64 // number of read bytes of the stream
+	Stage  Stage // stage of the frame
+	Length int64 // declared length of the piece, -1 if not read
+	Err    error // underlying error
+}
+
+// Error implements error interface.
+func (f *FrameError) Error() string {
+	return fmt.Sprintf("frame %d at offset %d, %s (length %d): %v",
+		f.Frame, f.Offset, f.Stage, f.Length, f.Err)
+}
+
+// Unwrap returns underlying error.
+func (f *FrameError) Unwrap() error {
+	return f.Err
+}
+
 // validate length
-func (r *reader) validateLen(l int) error {
+func (b *base) validateLen(l int) error {
 	if l < 0 {
 		return ErrNegativeLength
 	}
-	if l > r.max {
+	if l > b.max {
 		return ErrSizeLimit
 	}
 	return nil
 }
 
-func (r *reader) validateLen64(l64 int64) (l int, err error) {
+func (b *base) validateLen64(l64 int64) (l int, err error) {
 	if l64 < 0 {
 		err = ErrNegativeLength
 		return
 	}
-	if l64 > int64(r.max) {
+	if l64 > int64(b.max) {
 		err = ErrSizeLimit
 		return
 	}
@@ -296,74 +791,578 @@ func (r *reader) validateLen64(l64 int64) (l int, err error) {
 	return
 }
 
-func (r *reader) readLen() (l int, err error) {
+// errVarintOverflow occurs when a varint encoded
+// length doesn't fit 64 bits
+var errVarintOverflow = errors.New("varint overflows a 64-bit integer")
+
+// readLen64 reads declared length; read bytes
+// of the length are kept between calls
+func (r *reader) readLen64() (l64 int64, err error) {
 	if r.varint {
-		var l64 int64
-		if l64, err = binary.ReadVarint(r.b); err != nil {
-			return
+		var c byte
+		for {
+			if c, err = r.b.ReadByte(); err != nil {
+				if r.lenn > 0 {
+					err = unexpectedEOF(err)
+				}
+				return
+			}
+			r.lenb[r.lenn] = c
+			r.off++
+			if r.lenn++; c < 0x80 {
+				break
+			}
+			if r.lenn == len(r.lenb) {
+				return 0, errVarintOverflow
+			}
+		}
+		var n int
+		if l64, n = binary.Varint(r.lenb[:r.lenn]); n <= 0 {
+			return 0, errVarintOverflow
 		}
-		return r.validateLen64(l64)
+		r.mark()
+		r.lenn = 0
+		return
 	}
 	// read fixed size length
-	if _, err = io.ReadFull(r.r, r.lenb); err != nil {
+	var m int
+	m, err = io.ReadFull(r.r, r.lenb[r.lenn:])
+	r.off += int64(m)
+	if r.lenn += m; err != nil {
+		if r.lenn > 0 {
+			err = unexpectedEOF(err)
+		}
 		return
 	}
+	r.mark()
+	r.lenn = 0
 	if r.max <= maxInt32 {
-		l = int(binary.BigEndian.Uint32(r.lenb))
-		err = r.validateLen(l) // uint32
+		l64 = int64(binary.BigEndian.Uint32(r.lenb)) // uint32
 		return
 	}
-	return r.validateLen64(int64(binary.BigEndian.Uint64(r.lenb)))
+	l64 = int64(binary.BigEndian.Uint64(r.lenb))
+	return
 }
 
-func (r *reader) read() (piece []byte, err error) {
+// readLen reads and validates length of
+// a piece or first chunk of a piece
+func (r *reader) readLen() (err error) {
+	var l64 int64
+	var more bool
+	if l64, more, err = r.readChunkLen(); err != nil {
+		return
+	}
+	r.dlen = l64
 	var l int
-	if l, err = r.readLen(); err != nil {
+	if l, err = r.validateLen64(l64); err != nil {
+		if err == ErrSizeLimit && r.skip {
+			err = r.startSkip(l64, more)
+		}
 		return
 	}
-	piece = r.get(l)
-	_, err = io.ReadFull(r.r, piece)
+	r.stage, r.plen, r.more = stagePayload, l, more
 	return
 }
 
-func (r *reader) readWithHeading() (piece []byte, err error) {
-retry:
-	if err = r.findHeading(); err != nil {
+// readChunkLen reads declared length; for the Chunked
+// option it decodes length of a continuation chunk
+// and reports whether more chunks follow
+func (r *reader) readChunkLen() (l64 int64, more bool, err error) {
+	if l64, err = r.readLen64(); err != nil || !r.chunked {
 		return
 	}
-	if piece, err = r.read(); err != nil {
-		// not a reader error
-		switch err {
-		case ErrSizeLimit, ErrNegativeLength:
-			goto retry
+	switch {
+	case r.varint:
+		if more = l64 < 0 && l64 != math.MinInt64; more {
+			l64 = -l64
+		}
+	case r.max <= maxInt32:
+		if more = l64 > math.MaxInt32; more {
+			l64 &= math.MaxInt32
+		}
+	default:
+		if more = l64 < 0; more {
+			l64 &= math.MaxInt64
 		}
 	}
 	return
 }
 
-// Read reads next piece of data.
-func (r *reader) Read() ([]byte, error) {
-	if len(r.heading) > 0 {
-		return r.readWithHeading()
+// nextChunk reads length of next chunk of a chunked
+// piece; total is size of previous chunks
+func (r *reader) nextChunk(total int64) (l64 int64, more bool, err error) {
+	if l64, more, err = r.readChunkLen(); err != nil {
+		err = unexpectedEOF(err)
+		return
+	}
+	if l64 < 0 {
+		err = ErrNegativeLength
+		return
+	}
+	if r.addLen(l64); l64 > int64(r.max)-total {
+		err = ErrSizeLimit
+	}
+	return
+}
+
+// addLen adds length of a chunk to the declared length
+func (r *reader) addLen(l64 int64) {
+	if r.dlen += l64; r.dlen < 0 {
+		r.dlen = math.MaxInt64 // overflow
 	}
-	return r.read()
+}
+
+// startSkip starts skipping of a piece that exceeds
+// the MaxSize; l64 is length of current chunk
+func (r *reader) startSkip(l64 int64, more bool) error {
+	r.dropPart()
+	r.stage, r.more, r.skipn = stageSkip, more, l64
+	return r.skipPiece()
+}
+
+// skipPiece discards rest of a piece that exceeds the
+// MaxSize without allocations
+func (r *reader) skipPiece() (err error) {
+	var m int64
+	for {
+		m, err = io.CopyN(io.Discard, r.r, r.skipn)
+		r.skipn -= m
+		if r.off += m; err != nil {
+			return r.fail(unexpectedEOF(err))
+		}
+		if !r.more {
+			break
+		}
+		var l64 int64
+		var more bool
+		if l64, more, err = r.readChunkLen(); err != nil {
+			return r.failAt(StageLength, unexpectedEOF(err))
+		}
+		if l64 < 0 {
+			return r.failAt(StageLength, ErrNegativeLength)
+		}
+		r.addLen(l64)
+		r.skipn, r.more = l64, more
+	}
+	if err = r.readSum(); err != nil {
+		return r.fail(err)
+	}
+	var over error = &SizeLimitError{Size: r.dlen, MaxSize: r.max}
+	if r.over {
+		over = ErrBudgetLimit
+	}
+	err = r.frameError(StagePayload, over)
+	r.reset()
+	return
+}
+
+// skipOver skips a piece that never fits the Budget
+func (r *reader) skipOver() error {
+	r.over = true
+	return r.startSkip(int64(r.plen), r.more)
+}
+
+// overBudget reports whether known length of current
+// piece exceeds limit of the Budget
+func (r *reader) overBudget() bool {
+	return r.budget != nil && r.stage == stagePayload &&
+		r.partn+r.plen > r.budget.limit
+}
+
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF,
+// for errors that occur inside a piece
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// isTimeout reports whether given error is
+// a timeout, e.g. net.Conn deadline exceeded
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
+
+// where returns stage of current frame
+func (r *reader) where() Stage {
+	switch r.stage {
+	case stageHeading:
+		return StageHeading
+	case stageLength:
+		return StageLength
+	case stageChecksum:
+		return StageChecksum
+	case stageSkip:
+		if r.skipn == 0 && !r.more {
+			return StageChecksum
+		}
+	case stageStream:
+		if r.cur != nil && r.cur.n == 0 && !r.more {
+			return StageChecksum
+		}
+	}
+	return StagePayload
+}
+
+// frameError wraps given error with current
+// position in the stream
+func (r *reader) frameError(s Stage, err error) error {
+	return &FrameError{
+		Frame:  r.frame,
+		Offset: r.off,
+		Stage:  s,
+		Length: r.dlen,
+		Err:    err,
+	}
+}
+
+// fail resets state of current frame, unless given
+// error is a timeout; this way next call continues
+// the frame after a timeout; without a Heading the
+// Reader can't find next frame, and any other error
+// in the middle of a frame breaks the Reader
+func (r *reader) fail(err error) error {
+	return r.failAt(r.where(), err)
+}
+
+// failAt is the fail with given stage
+func (r *reader) failAt(s Stage, err error) error {
+	if isTimeout(err) {
+		return err
+	}
+	err = r.frameError(s, err)
+	r.rescan()
+	r.reset()
+	if len(r.heading) == 0 {
+		r.err = err
+	}
+	return err
+}
+
+// Err returns error that broke the Reader, if any.
+func (r *reader) Err() error {
+	return r.err
+}
+
+// readSum reads checksum trailer, if any
+func (r *reader) readSum() (err error) {
+	if !r.checksum {
+		return
+	}
+	var m int
+	m, err = io.ReadFull(r.r, r.sumb[r.sumn:])
+	r.off += int64(m)
+	if r.sumn += m; err != nil {
+		return unexpectedEOF(err)
+	}
+	r.sumn = 0
+	return
+}
+
+// read payload of a piece growing the piece as data
+// arrives (all at once, if the Incremental is not
+// set); it also reassembles chunks of a chunked
+// piece and verifies checksum; the read piece is
+// kept in the part until the take
+func (r *reader) read() (piece []byte, err error) {
+	var m int
+	for r.stage == stagePayload {
+		for r.plen > 0 {
+			if r.partn == len(r.part) {
+				if err = r.grow(); err == ErrBudgetLimit {
+					return nil, r.skipOver()
+				} else if err != nil {
+					return // keep the state to retry
+				}
+			}
+			end := len(r.part)
+			if end-r.partn > r.plen {
+				end = r.partn + r.plen
+			}
+			m, err = io.ReadFull(r.r, r.part[r.partn:end])
+			r.partn += m
+			r.off += int64(m)
+			if r.plen -= m; err != nil {
+				return nil, r.fail(unexpectedEOF(err)) // puts the part back
+			}
+		}
+		if !r.more {
+			r.stage = stageChecksum
+			break
+		}
+		var l64 int64
+		var more bool
+		if l64, more, err = r.nextChunk(int64(r.partn)); err != nil {
+			if err == ErrSizeLimit && r.skip {
+				return nil, r.startSkip(l64, more)
+			}
+			return nil, r.failAt(StageLength, err)
+		}
+		r.plen, r.more = int(l64), more
+	}
+	if r.stage == stageChecksum {
+		if err = r.readSum(); err != nil {
+			return nil, r.fail(err)
+		}
+		if r.part == nil { // empty piece
+			if r.part = []byte{}; r.kind == partPool {
+				r.part = r.get(0)
+			}
+		}
+		if r.checksum && binary.BigEndian.Uint32(r.sumb[:]) !=
+			crc32.Checksum(r.part[:r.partn], castagnoli) {
+			err = r.frameError(StageChecksum, ErrChecksum)
+			r.sumn = len(r.sumb)
+			r.rescan()
+			r.reset() // garbage
+			return nil, err
+		}
+		r.stage = stageDone
+	}
+	return r.part[:r.partn], nil
+}
+
+// take returns read piece and resets state of the frame
+func (r *reader) take() (piece []byte) {
+	piece = r.part[:r.partn]
+	if r.kind == partPool {
+		r.release(r.held - r.partn)
+	}
+	r.part, r.held = nil, 0
+	r.reset()
+	return
+}
+
+// grow allocates first or next part of a piece
+func (r *reader) grow() (err error) {
+	n, size := len(r.part), incrementalChunk
+	if n > 0 {
+		size = 2 * n
+		if n > r.max-n {
+			size = r.max
+		}
+	}
+	known := r.partn + r.plen
+	if !r.incremental && (n == 0 || size < known) {
+		size = known // trust the length
+	}
+	// the size is known, if it's last chunk
+	if !r.more && size > known {
+		size = known
+	} else if size > r.max {
+		size = r.max
+	}
+	if r.kind == partScratch {
+		if cap(r.scratch) < size {
+			grown := make([]byte, size)
+			copy(grown, r.part[:r.partn])
+			r.scratch = grown
+		}
+		r.part = r.scratch[:size]
+		return
+	}
+	if r.budget != nil {
+		if r.overBudget() {
+			return ErrBudgetLimit
+		}
+		if size > r.budget.limit {
+			size = r.budget.limit
+		}
+	}
+	if err = r.reserve(size); err != nil {
+		return
+	}
+	grown := r.get(size)
+	if r.part != nil {
+		copy(grown, r.part[:r.partn])
+		r.put(r.part)
+	}
+	r.part = grown
+	return
+}
+
+// reserve holds size bytes of the Budget for the part;
+// in the BudgetWait mode it releases held bytes before
+// waiting, since Readers that wait holding parts of
+// pieces can hold all the Budget forever
+func (r *reader) reserve(size int) (err error) {
+	if r.budget == nil || size <= r.held {
+		return
+	}
+	if r.budget.TryAcquire(size - r.held) {
+		r.held = size
+		return
+	}
+	if !r.budgetWait {
+		return ErrBudgetExhausted
+	}
+	r.release(r.held)
+	r.held = 0
+	if err = r.budget.Acquire(r.ctx, size); err == nil {
+		r.held = size
+	}
+	return
+}
+
+// dropPart drops incrementally read part of a piece
+func (r *reader) dropPart() {
+	if r.part != nil && r.kind == partPool {
+		r.put(r.part)
+	}
+	r.release(r.held)
+	r.part, r.partn, r.held = nil, 0, 0
+}
+
+// reset state of current frame
+func (r *reader) reset() {
+	r.dropPart()
+	if r.stage != stageHeading {
+		r.frame++
+	}
+	r.stage, r.hn, r.hw, r.lenn, r.sumn = stageHeading, 0, 0, 0, 0
+	r.plen, r.more, r.skipn, r.dlen = 0, false, 0, -1
+	r.over = false
+	r.lens, r.marks = r.lens[:0], r.marks[:0]
+}
+
+// readHeader reads heading and length of next piece,
+// if they are not read yet; it also continues skipping
+// of an oversize piece
+func (r *reader) readHeader() (err error) {
+	for {
+		switch r.stage {
+		case stageHeading:
+			if len(r.heading) > 0 {
+				if err = r.findHeading(); err == io.EOF {
+					return // clean end of the stream
+				} else if err != nil {
+					return r.fail(err)
+				}
+			}
+			r.stage = stageLength
+		case stageLength:
+			err = r.readLen()
+			switch {
+			case err == nil:
+				continue
+			case r.stage != stageLength:
+				return // skipped or being skipped
+			case len(r.heading) > 0:
+				if err == ErrSizeLimit || err == ErrNegativeLength {
+					r.rescan()
+					r.reset()
+					continue // not a reader error
+				}
+				err = unexpectedEOF(err)
+			case r.lenn == 0 && err != ErrSizeLimit &&
+				err != ErrNegativeLength:
+				if err != io.EOF { // nothing is read, not broken
+					err = r.frameError(StageLength, err)
+				}
+				return
+			}
+			return r.fail(err)
+		case stageSkip:
+			return r.skipPiece()
+		default:
+			return // payload
+		}
+	}
+}
+
+// Read reads next piece of data. If a reader
+// returned by NextReader is not read to end,
+// then the rest of its piece is discarded.
+// If an underlying io.Reader returns a timeout
+// error (e.g. a net.Conn deadline exceeded),
+// then the Read returns it, and next Read
+// continues the same frame.
+func (r *reader) Read() (piece []byte, err error) {
+	if r.err != nil {
+		return nil, broken(r.err)
+	}
+	if err = r.drain(); err != nil {
+		return
+	}
+	for {
+		if err = r.readHeader(); err != nil {
+			return
+		}
+		if err = r.adopt(partPool, nil); err == ErrBudgetLimit {
+			err = r.skipOver()
+		}
+		if err != nil {
+			return // budget error, keep the state
+		}
+		if _, err = r.read(); err != nil {
+			if r.resync(err) {
+				continue // wrong position, skip the frame
+			}
+			return
+		}
+		return r.take(), nil
+	}
+}
+
+// resync reports whether given error of a piece
+// means wrong position of a Reader with a Heading
+func (r *reader) resync(err error) bool {
+	return len(r.heading) > 0 && (errors.Is(err, ErrChecksum) ||
+		errors.Is(err, ErrSizeLimit) || errors.Is(err, ErrNegativeLength))
 }
 
 type writer struct {
-	w io.Writer
+	w   io.Writer
+	dst io.Writer // the underlying io.Writer
 	base
+	cur *pieceWriter // current writer returned by NextWriter
+	buf *flushWriter // the buffer, if the BufferSize is set
+	// partially written frame (kept on timeouts)
+	frame int       // kind of the frame, 0 - no frame
+	bufs  [4][]byte // unwritten heading, length, payload and checksum
+	bufi  int       // first unwritten buffer
+	piece []byte    // piece of the frame
+	owned bool      // put the piece to a Pool
+	sent  bool      // some bytes of the frame are written
+	rest  []byte    // copy of unwritten part of the payload
+	kept  bool      // the payload is copied to the rest
+	err   error     // error that broke the Writer
+	// to write a frame by one call
+	vectored bool        // the io.Writer supports writev
+	vec      net.Buffers // buffers for the writev
+	vecs     [4][]byte   // memory of the vec
+	scratch  []byte      // small frames are copied here
+	// the WriteBatch
+	batch    []byte      // encoded frames
+	batchVec net.Buffers // the batch and large pieces
+	ends     []int64     // end of each frame
 }
 
-// NewWriter creates Writer interface over given
+// coalesceMax is max size of a frame that's
+// copied to be written by one call
+const coalesceMax = 4 << 10
+
+// kinds of partially written frames
+const (
+	framePiece   = iota + 1 // written by Write
+	frameHeader             // heading and length written by NextWriter
+	frameChunk              // chunk of a chunked piece
+	frameTrailer            // last chunk and checksum
+)
+
+// NewWriter creates FrameWriter interface over given
 // io.Writer using given *Config. If *Config
 // is nil then DefaultConfig() is used. If given
 // io.Writer is nil then first Write causes panic.
 // Error indicates that *Config is incorrect.
 // If a Pool is given then each Write automatically
-// puts a piece of data to the Pool. But if any
-// error occurs during writing then the piece
-// will not be put to the Pool.
-func NewWriter(w io.Writer, c *Config) (_ Writer, err error) {
+// puts a piece of data to the Pool, unless the
+// Borrowed option is set. But if any error occurs
+// during writing then the piece will not be put
+// to the Pool.
+func NewWriter(w io.Writer, c *Config) (_ FrameWriter, err error) {
 	if c == nil {
 		c = DefaultConfig()
 	}
@@ -371,59 +1370,207 @@ func NewWriter(w io.Writer, c *Config) (_ Writer, err error) {
 		return
 	}
 	q := new(writer)
-	q.w = w
-	q.max = c.MaxSize
-	q.pool = c.Pool
-	q.varint = c.Varint
-	q.heading = c.Heading
-	if q.varint {
-		q.lenb = make([]byte, 10) // for varints
-	} else if q.max <= maxInt32 {
-		q.lenb = make([]byte, 4)
-	} else {
-		q.lenb = make([]byte, 8)
+	if q.w, q.dst = w, w; c.BufferSize > 0 {
+		q.buf = newFlushWriter(w, c.BufferSize, c.FlushInterval)
+		q.w = q.buf
 	}
+	switch q.w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		q.vectored = true
+	}
+	q.init(c)
+	q.lenb = make([]byte, q.lenSize())
 	return q, nil
 }
 
-func (w *writer) put(piece []byte) {
-	if w.pool != nil {
-		w.pool.Put(piece)
+func (b *base) put(piece []byte) {
+	if b.pool != nil {
+		if b.debug {
+			borrowed.check(piece)
+		}
+		b.pool.Put(piece)
+	}
+}
+
+// writeFrame writes the frame; on a timeout it keeps
+// unwritten part of the frame to continue it later
+func (w *writer) writeFrame() (err error) {
+	var n int64
+	for ; w.bufi < len(w.bufs); w.bufi++ {
+		for len(w.bufs[w.bufi]) > 0 {
+			if n, err = w.writeBufs(); err == nil && n == 0 {
+				err = io.ErrShortWrite
+			}
+			w.advance(n)
+			w.sent = w.sent || n > 0
+			if err != nil {
+				if isTimeout(err) {
+					w.keep()
+					return
+				}
+				if w.sent || w.frame == frameChunk || w.frame == frameTrailer {
+					w.fail(err) // in the middle of a frame
+				}
+				w.dropFrame()
+				return
+			}
+		}
+	}
+	if w.frame == framePiece && w.owned {
+		w.put(w.piece)
+	}
+	w.dropFrame()
+	return
+}
+
+// writeBufs writes unwritten buffers of the frame by one
+// call: a small frame is copied to the scratch, a large
+// one is written using writev; without writev a large
+// payload is written as is
+func (w *writer) writeBufs() (n int64, err error) {
+	bufs := w.bufs[w.bufi:]
+	var size int
+	for _, b := range bufs {
+		size += len(b)
+	}
+	if w.vectored && size > coalesceMax {
+		w.vec = append(w.vecs[:0], bufs...)
+		return w.vec.WriteTo(w.w)
+	}
+	if len(bufs[0]) > coalesceMax {
+		var m int
+		m, err = w.w.Write(bufs[0])
+		return int64(m), err
+	}
+	w.scratch = w.scratch[:0]
+	for _, b := range bufs {
+		if len(w.scratch)+len(b) > coalesceMax {
+			break
+		}
+		w.scratch = append(w.scratch, b...)
+	}
+	var m int
+	m, err = w.w.Write(w.scratch)
+	return int64(m), err
+}
+
+// advance skips n written bytes of the frame
+func (w *writer) advance(n int64) {
+	for i := w.bufi; n > 0 && i < len(w.bufs); i++ {
+		b := w.bufs[i]
+		m := min(n, int64(len(b)))
+		w.bufs[i] = b[m:]
+		n -= m
+	}
+}
+
+// keep copies unwritten part of a payload after a timeout,
+// thus the frame doesn't refer to memory of a caller, and
+// the piece is written from the point of view of the caller;
+// the payload is copied once, and an owned piece is kept
+// as is; heading, length and checksum are memory of the
+// Writer
+func (w *writer) keep() {
+	if w.kept || w.owned || len(w.bufs[2]) == 0 {
+		return
 	}
+	w.rest = append(w.rest[:0], w.bufs[2]...)
+	w.bufs[2], w.piece, w.kept = w.rest, nil, true
+}
+
+// pending writes rest of a frame kept after a timeout;
+// a NextWriter and its io.WriteCloser continue their
+// own frames
+func (w *writer) pending() error {
+	if w.frame == framePiece || w.frame == frameChunk {
+		return w.writeFrame()
+	}
+	return nil
+}
+
+func (w *writer) dropFrame() {
+	w.frame, w.bufs, w.bufi, w.piece = 0, [4][]byte{}, 0, nil
+	w.sent, w.owned, w.kept = false, false, false
+	if cap(w.rest) > coalesceMax {
+		w.rest = nil // don't hold a large frame
+	}
+}
+
+// fail breaks the Writer, unless given error is a timeout;
+// a Reader with a Heading finds next frame, thus a Writer
+// with a Heading is never broken
+func (w *writer) fail(err error) error {
+	if !isTimeout(err) && len(w.heading) == 0 {
+		w.err = err
+	}
+	return err
+}
+
+// Err returns error that broke the Writer, if any.
+func (w *writer) Err() error {
+	return w.err
+}
+
+// same reports whether given slices are the same
+func same(a, b []byte) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
 }
 
 // Write writes given piece to undelying io.Writer.
 // It also writes nil and pieces wich lenength is 0.
 // If a length of a piece exceeds a size limit
-// then ErrSizeLimit is returned.
-func (w *writer) Write(piece []byte) (err error) {
-	if len(piece) > w.max {
-		err = ErrSizeLimit
-		return
+// then ErrSizeLimit is returned. If underlying
+// io.Writer returns a timeout error (e.g. a net.Conn
+// deadline exceeded), then the piece is written anyway:
+// the Writer keeps unwritten rest of the frame (a
+// borrowed piece is copied once), and the Flush writes
+// it. Don't write the piece again.
+// Any other write call writes the rest first, and if
+// it can't, then it returns ErrPending wrapping the
+// error, and its piece is not written. The piece is
+// owned, unless the Borrowed option is set.
+func (w *writer) Write(piece []byte) error {
+	return w.write(piece, !w.borrowed)
+}
+
+// WriteOwned is the Write that puts given piece
+// to a Pool after writing. The piece must not be
+// used after the call, unless an error returned
+// (but a timeout, the piece is written then).
+func (w *writer) WriteOwned(piece []byte) error {
+	return w.write(piece, true)
+}
+
+// WriteBorrowed is the Write that never puts given
+// piece to a Pool. The piece can be used after the
+// call, even after a timeout.
+func (w *writer) WriteBorrowed(piece []byte) error {
+	return w.write(piece, false)
+}
+
+func (w *writer) write(piece []byte, owned bool) (err error) {
+	if w.debug && !owned {
+		borrowed.add(piece)
 	}
-	if len(w.heading) > 0 {
-		if _, err = w.w.Write(w.heading); err != nil {
-			return
-		}
+	if w.err != nil {
+		return broken(w.err)
 	}
-	if w.varint {
-		n := binary.PutVarint(w.lenb, int64(len(piece)))
-		if _, err = w.w.Write(w.lenb[:n]); err != nil {
-			return
-		}
-	} else {
-		if w.max <= maxInt32 {
-			binary.BigEndian.PutUint32(w.lenb, uint32(len(piece)))
-		} else {
-			binary.BigEndian.PutUint64(w.lenb, uint64(len(piece)))
-		}
-		if _, err = w.w.Write(w.lenb); err != nil {
-			return
+	if w.frame == framePiece {
+		if err = w.writeFrame(); err != nil {
+			return pending(err)
 		}
 	}
-	if _, err = w.w.Write(piece); err != nil {
+	if err = w.finish(); err != nil {
 		return
 	}
-	w.put(piece)
-	return
+	if len(piece) > w.max {
+		err = ErrSizeLimit
+		return
+	}
+	w.frame, w.piece, w.owned = framePiece, piece, owned
+	w.bufs[0], w.bufs[1], w.bufs[2] = w.heading, w.putLen(len(piece)), piece
+	if w.checksum {
+		w.bufs[3] = w.sum(piece)
+	}
+	return w.writeFrame()
 }
@@ -29,7 +29,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 /*
@@ -54,38 +60,23 @@ func TestConfig_Check(t *testing.T) {
 	}
 }
 
-func Test_look(t *testing.T) {
-	{ // equal
-		hs := []byte("hello")
-		ts := hs
-		if n := look(hs, ts); n != 0 {
-			t.Error("look(equal) wrong value; expected 0, got", n)
+func Test_kmp(t *testing.T) {
+	for heading, want := range map[string][]int{
+		"hello":   {0, 0, 0, 0, 0},
+		"hhhhh":   {0, 1, 2, 3, 4},
+		"abab":    {0, 0, 1, 2},
+		"aabaaab": {0, 1, 0, 1, 2, 2, 3},
+	} {
+		next := kmp([]byte(heading))
+		if len(next) != len(want) {
+			t.Errorf("kmp(%q): wrong length %d", heading, len(next))
+			continue
 		}
-	}
-	{ // not equal
-		hs := []byte("hello")
-		ts := []byte("ppppp")
-		if n := look(hs, ts); n != len(hs) {
-			t.Errorf("look(equal) wrong value; expected %d, got %d", len(hs), n)
-		}
-	}
-	{ // shifted
-		hs := []byte("hello")
-		ts := []byte("ppphe")
-		if n := look(hs, ts); n != 3 {
-			t.Error("look(equal) wrong value; expected 3, got", n)
-		}
-	}
-	{ // shifted (first)
-		hs := []byte("hhhhh")
-		ts := []byte("phhhh")
-		if n := look(hs, ts); n != 1 {
-			t.Error("look(equal) wrong value; expected 1, got", n)
-		}
-	}
-	{ // coverage
-		if n := look(nil, nil); n != 0 {
-			t.Error("look(nil, nil): expected 0, got", n)
+		for i := range want {
+			if next[i] != want[i] {
+				t.Errorf("kmp(%q): want %v, got %v", heading, want, next)
+				break
+			}
 		}
 	}
 }
@@ -100,6 +91,14 @@ func TestNewReader(t *testing.T) {
 	}
 }
 
+// the reader and the writer implement the interfaces
+var (
+	_ Reader      = (*reader)(nil)
+	_ FrameReader = (*reader)(nil)
+	_ Writer      = (*writer)(nil)
+	_ FrameWriter = (*writer)(nil)
+)
+
 func TestNewReader_badConfigs(t *testing.T) {
 	if _, err := NewReader(nil, &Config{MaxSize: -1}); err == nil {
 		t.Fatal("NewReader with bad configs: missing error")
@@ -132,8 +131,8 @@ func TestNewReader_uint32(t *testing.T) {
 	if err != nil {
 		t.Fatal("NewReader unexpected error:", err)
 	}
-	if r.(*reader).b != nil {
-		t.Error("NewReader creates ByteReader for fixed size encoding")
+	if r.(*reader).br == nil {
+		t.Error("NewReader doesn't buffer underlying io.Reader")
 	}
 	l := len(r.(*reader).lenb)
 	if l != 4 {
@@ -151,8 +150,8 @@ func TestNewReader_uint64(t *testing.T) {
 	if err != nil {
 		t.Fatal("NewReader unexpected error:", err)
 	}
-	if r.(*reader).b != nil {
-		t.Error("NewReader creates ByteReader for fixed size encoding")
+	if r.(*reader).br == nil {
+		t.Error("NewReader doesn't buffer underlying io.Reader")
 	}
 	l := len(r.(*reader).lenb)
 	if l != 8 {
@@ -180,9 +179,12 @@ func TestNewReader_heading(t *testing.T) {
 	if string(rr.heading) != string(heading) {
 		t.Error("NewReader doesn't keep heading")
 	}
-	if len(rr.headbuf) != len(heading) {
-		t.Errorf("NewReader wrong headbuf len, want %d, got: %d:",
-			len(rr.headbuf), len(heading))
+	if len(rr.next) != len(heading) {
+		t.Errorf("NewReader wrong next len, want %d, got: %d:",
+			len(heading), len(rr.next))
+	}
+	if rr.br == nil {
+		t.Error("NewReader doesn't create bufio.Reader for heading")
 	}
 }
 
@@ -547,15 +549,18 @@ func Test_writer_uint32_err(t *testing.T) {
 
 type secondWriteErr bool
 
-func (s *secondWriteErr) Write([]byte) (_ int, err error) {
+func (s *secondWriteErr) Write(p []byte) (_ int, err error) {
 	if *s {
 		err = errors.New("some error")
 		return
 	}
 	*s = true
-	return
+	return len(p), nil
 }
 
+// largePiece is not copied to be written by one call
+var largePiece = make([]byte, coalesceMax+1)
+
 // very synthetic (for the great coverage!)
 func Test_writer_uint32_second_err(t *testing.T) {
 	var swe secondWriteErr
@@ -563,7 +568,7 @@ func Test_writer_uint32_second_err(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := w.Write([]byte("I'm a piece")); err == nil {
+	if err := w.Write(largePiece); err == nil {
 		t.Error("missing error for writing heading")
 	}
 }
@@ -588,3 +593,1104 @@ func TestNewWriter_uint64(t *testing.T) {
 		t.Error("wrong size written")
 	}
 }
+
+type maxPool struct {
+	max  int // max requested size
+	gets int
+	puts int
+}
+
+func (m *maxPool) Get(size int) []byte {
+	if size > m.max {
+		m.max = size
+	}
+	m.gets++
+	return make([]byte, size)
+}
+
+func (m *maxPool) Put([]byte) { m.puts++ }
+
+func Test_reader_incremental_lying_length(t *testing.T) {
+	buf := new(bytes.Buffer)
+	lenb := make([]byte, 4)
+	binary.BigEndian.PutUint32(lenb, uint32(maxInt32))
+	buf.Write(lenb)
+	buf.WriteString("truncated")
+	p := new(maxPool)
+	r, err := NewReader(buf, &Config{
+		MaxSize:     maxInt32,
+		Pool:        p,
+		Incremental: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := r.Read()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("wrong error, want io.ErrUnexpectedEOF, got:", err)
+	}
+	if pc != nil {
+		t.Errorf("returns truncated piece %q", pc)
+	}
+	if p.puts != p.gets {
+		t.Errorf("truncated piece is not put back: %d gets, %d puts",
+			p.gets, p.puts)
+	}
+	if p.max != incrementalChunk {
+		t.Errorf("wrong allocation, want %d, got %d", incrementalChunk, p.max)
+	}
+}
+
+func testIncremental(t *testing.T, c *Config) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, &Config{MaxSize: c.MaxSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(buf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, incrementalChunk, incrementalChunk + 1,
+		10*incrementalChunk + 3} {
+		piece := bytes.Repeat([]byte{'x'}, size)
+		if err := w.Write(piece); err != nil {
+			t.Fatal(err)
+		}
+		p, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, piece) {
+			t.Errorf("wrong value for size %d, got %d bytes", size, len(p))
+		}
+	}
+}
+
+func Test_reader_incremental(t *testing.T) {
+	testIncremental(t, &Config{MaxSize: 1 << 20, Incremental: true})
+}
+
+func Test_reader_incremental_pool(t *testing.T) {
+	p := new(maxPool)
+	testIncremental(t, &Config{MaxSize: 1 << 20, Pool: p, Incremental: true})
+	if p.gets != p.puts+5 {
+		t.Errorf("intermediate pieces are not put back: %d gets, %d puts",
+			p.gets, p.puts)
+	}
+}
+
+func Test_reader_incremental_odd_max(t *testing.T) {
+	size := 3*incrementalChunk - 7
+	buf := new(bytes.Buffer)
+	c := &Config{MaxSize: size, Incremental: true, Pool: new(maxPool)}
+	w, _ := NewWriter(buf, &Config{MaxSize: size})
+	r, err := NewReader(buf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(make([]byte, size))
+	if p, err := r.Read(); err != nil {
+		t.Fatal(err)
+	} else if len(p) != size {
+		t.Errorf("wrong length, want %d, got %d", size, len(p))
+	}
+	if mx := c.Pool.(*maxPool).max; mx != size {
+		t.Errorf("wrong max allocation, want %d, got %d", size, mx)
+	}
+}
+
+func testChecksum(t *testing.T, c *Config) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(buf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"Hello, Lend!", "", "Bye"} {
+		if err := w.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		p, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != msg {
+			t.Errorf("wrong value, want %q, got %q", msg, string(p))
+		}
+	}
+}
+
+func Test_reader_writer_checksum(t *testing.T) {
+	testChecksum(t, &Config{MaxSize: 100, Checksum: true})
+	testChecksum(t, &Config{MaxSize: 100, Checksum: true, Varint: true})
+	testChecksum(t, &Config{MaxSize: 100, Checksum: true, Incremental: true})
+	testChecksum(t, &Config{MaxSize: 100, Checksum: true,
+		Heading: []byte("HEAD")})
+}
+
+func Test_writer_checksum(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, &Config{MaxSize: 100, Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write([]byte("123456789")); err != nil {
+		t.Fatal(err)
+	}
+	// CRC32C check value of "123456789" is 0xe3069283
+	want := []byte{0, 0, 0, 9, '1', '2', '3', '4', '5', '6', '7', '8', '9',
+		0xe3, 0x06, 0x92, 0x83}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("wrong frame, want %v, got %v", want, buf.Bytes())
+	}
+}
+
+func Test_reader_checksum_mismatch(t *testing.T) {
+	c := &Config{MaxSize: 100, Checksum: true, Pool: new(maxPool)}
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, &Config{MaxSize: 100, Checksum: true})
+	w.Write([]byte("corrupted"))
+	w.Write([]byte("piece"))
+	buf.Bytes()[5] ^= 0xff
+	r, err := NewReader(buf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := r.Read(); !errors.Is(err, ErrChecksum) {
+		t.Error("wrong error, want ErrChecksum, got:", err)
+	} else if p != nil {
+		t.Error("returns corrupted piece")
+	}
+	if c.Pool.(*maxPool).puts != 1 {
+		t.Error("corrupted piece is not put back to the Pool")
+	}
+	if p, err := r.Read(); err != nil {
+		t.Error("unexpected error:", err)
+	} else if string(p) != "piece" {
+		t.Errorf("wrong data, want %q, got %q", "piece", string(p))
+	}
+}
+
+func Test_reader_checksum_truncated(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, &Config{MaxSize: 100, Checksum: true})
+	w.Write([]byte("piece"))
+	buf.Truncate(buf.Len() - 4)
+	r, err := NewReader(buf, &Config{MaxSize: 100, Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("wrong error, want io.ErrUnexpectedEOF, got:", err)
+	}
+}
+
+func Test_reader_checksum_heading_resync(t *testing.T) {
+	heading := []byte("HEAD")
+	c := &Config{MaxSize: 100, Checksum: true, Heading: heading}
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, c)
+	w.Write([]byte("corrupted"))
+	buf.Bytes()[len(heading)+5] ^= 0xff
+	// heading inside payload
+	buf.Write(heading)
+	writeVarint(buf, 1) // wrong encoding of the length
+	w.Write([]byte("xx"))
+	w.Write([]byte("piece"))
+	r, err := NewReader(buf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the frame that starts inside the length is found
+	for _, want := range []string{"xx", "piece"} {
+		if p, err := r.Read(); err != nil {
+			t.Error("unexpected error:", err)
+		} else if string(p) != want {
+			t.Errorf("wrong data, want %q, got %q", want, string(p))
+		}
+	}
+}
+
+// frames inside a payload of a false heading are found
+func Test_reader_heading_rescan(t *testing.T) {
+	reads := map[string]func(r FrameReader) ([]byte, error){
+		"Read":       FrameReader.Read,
+		"ReadNoCopy": FrameReader.ReadNoCopy,
+		"ReadInto": func(r FrameReader) ([]byte, error) {
+			b := make([]byte, 100)
+			n, err := r.ReadInto(b)
+			return b[:n], err
+		},
+	}
+	for _, c := range testConfigs(func(c *Config) {
+		c.Heading, c.Checksum = []byte("HEAD"), true
+	}) {
+		frames := new(bytes.Buffer)
+		w, _ := NewWriter(frames, c)
+		w.Write([]byte("one"))
+		size := frames.Len()
+		w.Write([]byte("two"))
+		// false heading and length of a piece that covers
+		// first frame and a part of second one
+		buf := new(bytes.Buffer)
+		w, _ = NewWriter(buf, c)
+		w.Write(make([]byte, size+2))
+		buf.Truncate(buf.Len() - (size + 2) - 4)
+		buf.Write(frames.Bytes())
+		for name, read := range reads {
+			r, _ := NewReader(bytes.NewReader(buf.Bytes()), c)
+			for _, want := range []string{"one", "two"} {
+				if p, err := read(r); err != nil || string(p) != want {
+					t.Errorf("%s %+v: unexpected result: %q, %v",
+						name, c, p, err)
+				}
+			}
+		}
+	}
+}
+
+// a frame inside a chunk of a false chunked piece is found
+func Test_reader_heading_rescan_chunked(t *testing.T) {
+	c := &Config{MaxSize: 100, Heading: []byte("HEAD"), Checksum: true,
+		Chunked: true}
+	frames := new(bytes.Buffer)
+	w, _ := NewWriter(frames, c)
+	w.Write([]byte("one"))
+	one := append([]byte{}, frames.Bytes()...)
+	w.Write([]byte("two"))
+	buf := new(bytes.Buffer)
+	w, _ = NewWriter(buf, c)
+	writeChunked(t, w, "abc", string(one))
+	buf.Bytes()[buf.Len()-1] ^= 0xff // checksum mismatch
+	buf.Write(frames.Bytes()[len(one):])
+	r, _ := NewReader(buf, c)
+	for _, want := range []string{"one", "two"} {
+		if p, err := r.Read(); err != nil || string(p) != want {
+			t.Errorf("unexpected result: %q, %v", p, err)
+		}
+	}
+}
+
+func Test_writer_checksum_err(t *testing.T) {
+	var swe thirdWriteErr
+	w, err := NewWriter(&swe, &Config{MaxSize: 2 * coalesceMax,
+		Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(largePiece); err == nil {
+		t.Error("missing error for writing checksum")
+	}
+}
+
+type thirdWriteErr int
+
+func (s *thirdWriteErr) Write(p []byte) (_ int, err error) {
+	if *s == 2 {
+		err = errors.New("some error")
+		return
+	}
+	*s++
+	return len(p), nil
+}
+
+func Test_reader_findHeading(t *testing.T) {
+	heading := []byte("aabaaab")
+	for _, noise := range []string{
+		"",
+		"aabaaa",
+		"aabaaaab",
+		"aaaaaaaaaaaa",
+		"aabaabaaaabaabaaa",
+		"baaabaaba",
+	} {
+		for _, one := range []bool{false, true} {
+			var src io.Reader = strings.NewReader(noise +
+				string(heading) + "tail")
+			if one {
+				src = iotest.OneByteReader(src)
+			}
+			r, err := NewReader(src, &Config{MaxSize: 10, Heading: heading})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := r.(*reader)
+			if err := rr.findHeading(); err != nil {
+				t.Errorf("%q: unexpected error: %v", noise, err)
+				continue
+			}
+			data := noise + string(heading) + "tail"
+			want := data[strings.Index(data, string(heading))+len(heading):]
+			rest, _ := io.ReadAll(rr.r)
+			if string(rest) != want {
+				t.Errorf("%q: wrong position, rest is %q", noise, rest)
+			}
+		}
+	}
+}
+
+func Test_reader_findHeading_random(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	heading := []byte("abab")
+	for i := 0; i < 1000; i++ {
+		data := make([]byte, rnd.Intn(64))
+		for j := range data {
+			data[j] = "ab"[rnd.Intn(2)]
+		}
+		r, err := NewReader(iotest.HalfReader(bytes.NewReader(data)),
+			&Config{MaxSize: 10, Heading: heading})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := r.(*reader)
+		var pos int // expected position after heading
+		for {
+			k := bytes.Index(data[pos:], heading)
+			err := rr.findHeading()
+			if k < 0 {
+				if err == nil {
+					t.Fatalf("%q: missing error", data)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("%q: unexpected error: %v", data, err)
+			}
+			pos += k + len(heading)
+			if rest, _ := rr.br.Peek(rr.br.Buffered()); rr.br.Buffered() > 0 &&
+				!bytes.HasPrefix(data[pos:], rest) {
+				t.Fatalf("%q: wrong position %d", data, pos)
+			}
+		}
+	}
+}
+
+func Test_reader_findHeading_eof(t *testing.T) {
+	heading := []byte("HEAD")
+	for noise, want := range map[string]error{
+		"":         io.EOF,
+		"NN":       io.ErrUnexpectedEOF,
+		"NNNN":     io.EOF,
+		"NNNNNN":   io.ErrUnexpectedEOF,
+		"NNNNNNNN": io.EOF,
+		"NNNH":     io.EOF,
+		"NNNHEA":   io.ErrUnexpectedEOF,
+		"NNNHEAN":  io.EOF,
+		"NHEHEAD":  io.ErrUnexpectedEOF, // the heading is found
+	} {
+		r, err := NewReader(strings.NewReader(noise),
+			&Config{MaxSize: 10, Heading: heading})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Read(); !errors.Is(err, want) {
+			t.Errorf("%q: wrong error, want %v, got %v", noise, want, err)
+		}
+	}
+}
+
+func benchmarkFindHeading(b *testing.B, heading, noise []byte) {
+	data := bytes.Repeat(noise, (1<<20)/len(noise))
+	data = append(data, heading...)
+	src := bytes.NewReader(data)
+	r, err := NewReader(src, &Config{MaxSize: 10, Heading: heading})
+	if err != nil {
+		b.Fatal(err)
+	}
+	rr := r.(*reader)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src.Reset(data)
+		rr.br.Reset(src)
+		if err := rr.findHeading(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFindHeading_noise(b *testing.B) {
+	noise := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(noise)
+	for i := range noise {
+		if noise[i] == '=' {
+			noise[i] = 0
+		}
+	}
+	benchmarkFindHeading(b, []byte("= SOME DELIMITER ="), noise)
+}
+
+func BenchmarkFindHeading_partial(b *testing.B) {
+	heading := []byte("= SOME DELIMITER =")
+	benchmarkFindHeading(b, heading, heading[:len(heading)-2])
+}
+
+func BenchmarkFindHeading_repeated(b *testing.B) {
+	heading := append(bytes.Repeat([]byte{'H'}, 31), 'D')
+	benchmarkFindHeading(b, heading, heading[:len(heading)-1])
+}
+
+func testSkipOversize(t *testing.T, c *Config) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, &Config{MaxSize: 100, Varint: c.Varint,
+		Checksum: c.Checksum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("ok"))
+	w.Write([]byte("too large piece"))
+	w.Write([]byte("next"))
+	r, err := NewReader(buf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := r.Read(); err != nil || string(p) != "ok" {
+		t.Fatalf("unexpected result: %q, %v", p, err)
+	}
+	_, err = r.Read()
+	var sle *SizeLimitError
+	if !errors.As(err, &sle) {
+		t.Fatal("wrong error, want *SizeLimitError, got:", err)
+	}
+	if sle.Size != int64(len("too large piece")) || sle.MaxSize != c.MaxSize {
+		t.Errorf("wrong *SizeLimitError: %+v", sle)
+	}
+	if !errors.Is(err, ErrSizeLimit) {
+		t.Error("*SizeLimitError is not ErrSizeLimit")
+	}
+	if p, err := r.Read(); err != nil || string(p) != "next" {
+		t.Errorf("unexpected result: %q, %v", p, err)
+	}
+}
+
+func Test_reader_skip_oversize(t *testing.T) {
+	testSkipOversize(t, &Config{MaxSize: 5, SkipOversize: true})
+	testSkipOversize(t, &Config{MaxSize: 5, SkipOversize: true, Varint: true})
+	testSkipOversize(t, &Config{MaxSize: 5, SkipOversize: true,
+		Checksum: true})
+}
+
+func Test_reader_skip_oversize_truncated(t *testing.T) {
+	buf := writePieces(t, "too large piece")
+	buf.Truncate(buf.Len() - 1)
+	r, err := NewReader(buf, &Config{MaxSize: 5, SkipOversize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("wrong error, want io.ErrUnexpectedEOF, got:", err)
+	}
+}
+
+func Test_reader_skip_oversize_heading(t *testing.T) {
+	r, err := NewReader(nil, &Config{MaxSize: 5, SkipOversize: true,
+		Heading: []byte("HEAD")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.(*reader).skip {
+		t.Error("SkipOversize is not ignored with a Heading")
+	}
+}
+
+func TestSizeLimitError_Error(t *testing.T) {
+	err := &SizeLimitError{Size: 10, MaxSize: 5}
+	want := "size limit exceeded: piece of 10 bytes skipped (limit 5)"
+	if err.Error() != want {
+		t.Errorf("wrong message, want %q, got %q", want, err.Error())
+	}
+}
+
+// timeoutReader reads one byte per call and returns
+// os.ErrDeadlineExceeded every second call
+type timeoutReader struct {
+	r       io.Reader
+	timeout bool
+}
+
+func (t *timeoutReader) Read(p []byte) (n int, err error) {
+	if t.timeout = !t.timeout; t.timeout {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return t.r.Read(p)
+}
+
+// timeoutWriter writes one byte per call and returns
+// os.ErrDeadlineExceeded every second call
+type timeoutWriter struct {
+	w       io.Writer
+	timeout bool
+}
+
+func (t *timeoutWriter) Write(p []byte) (n int, err error) {
+	if t.timeout = !t.timeout; t.timeout {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return t.w.Write(p[:1])
+}
+
+// testConfigs returns new configs for each test, since
+// a Pool and a Budget keep state; given set, if any,
+// changes each config
+func testConfigs(set func(c *Config)) []*Config {
+	cs := []*Config{
+		{MaxSize: 100},
+		{MaxSize: 100, Varint: true},
+		{MaxSize: maxInt, Checksum: true},
+		{MaxSize: 100, Heading: []byte("HEAD"), Checksum: true},
+		{MaxSize: 100, Incremental: true, Pool: new(maxPool)},
+		{MaxSize: 100, Pool: new(maxPool), Budget: NewBudget(100)},
+	}
+	if set != nil {
+		for _, c := range cs {
+			set(c)
+		}
+	}
+	return cs
+}
+
+func Test_reader_timeout(t *testing.T) {
+	pieces := []string{"Hello, Lend!", "", "Bye"}
+	for _, c := range testConfigs(nil) {
+		buf := new(bytes.Buffer)
+		w, _ := NewWriter(buf, &Config{MaxSize: c.MaxSize, Varint: c.Varint,
+			Heading: c.Heading, Checksum: c.Checksum})
+		for _, p := range pieces {
+			w.Write([]byte(p))
+		}
+		r, err := NewReader(&timeoutReader{r: buf}, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var timeouts int
+		for _, want := range pieces {
+			p, err := r.Read()
+			for ; isTimeout(err); p, err = r.Read() {
+				timeouts++
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(p) != want {
+				t.Errorf("wrong piece, want %q, got %q", want, p)
+			}
+		}
+		if timeouts == 0 {
+			t.Error("no timeouts")
+		}
+		if _, err := r.Read(); err != io.EOF && !isTimeout(err) {
+			t.Error("wrong error, want io.EOF, got:", err)
+		}
+	}
+}
+
+func Test_reader_timeout_skip_oversize(t *testing.T) {
+	for _, c := range []*Config{
+		{MaxSize: 5, SkipOversize: true},
+		{MaxSize: 5, SkipOversize: true, Varint: true, Checksum: true},
+	} {
+		buf := new(bytes.Buffer)
+		w, _ := NewWriter(buf, &Config{MaxSize: 100, Varint: c.Varint,
+			Checksum: c.Checksum})
+		w.Write([]byte("too large piece"))
+		w.Write([]byte("next"))
+		r, err := NewReader(&timeoutReader{r: buf}, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := r.Read()
+		for ; isTimeout(err); p, err = r.Read() {
+		}
+		if !errors.Is(err, ErrSizeLimit) {
+			t.Fatal("wrong error, want *SizeLimitError, got:", err)
+		}
+		for p, err = r.Read(); isTimeout(err); p, err = r.Read() {
+		}
+		if err != nil || string(p) != "next" {
+			t.Errorf("unexpected result: %q, %v", p, err)
+		}
+	}
+}
+
+func Test_reader_varint_overflow(t *testing.T) {
+	buf := bytes.NewBuffer(bytes.Repeat([]byte{0xff}, 11))
+	r, err := NewReader(buf, &Config{MaxSize: 100, Varint: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); !errors.Is(err, errVarintOverflow) {
+		t.Error("wrong error, want errVarintOverflow, got:", err)
+	}
+	buf = bytes.NewBuffer(append(bytes.Repeat([]byte{0xff}, 9), 0x7f))
+	if r, err = NewReader(buf, &Config{MaxSize: 100, Varint: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); !errors.Is(err, errVarintOverflow) {
+		t.Error("wrong error, want errVarintOverflow, got:", err)
+	}
+}
+
+func Test_writer_timeout(t *testing.T) {
+	pieces := []string{"Hello, Lend!", "", "Bye"}
+	for _, c := range testConfigs(nil) {
+		c = &Config{MaxSize: c.MaxSize, Varint: c.Varint,
+			Heading: c.Heading, Checksum: c.Checksum}
+		buf := new(bytes.Buffer)
+		w, err := NewWriter(&timeoutWriter{w: buf}, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range pieces {
+			for err = w.Write([]byte(p)); isTimeout(err); err = w.Flush() {
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		r, _ := NewReader(buf, c)
+		for _, want := range pieces {
+			if p, err := r.Read(); err != nil || string(p) != want {
+				t.Errorf("unexpected result: %q, %v", p, err)
+			}
+		}
+	}
+}
+
+func Test_writer_timeout_next_piece(t *testing.T) {
+	buf := new(bytes.Buffer)
+	p := new(maxPool)
+	w, err := NewWriter(&timeoutWriter{w: buf}, &Config{MaxSize: 100, Pool: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write([]byte("first")); !isTimeout(err) {
+		t.Fatal("wrong error, want timeout, got:", err)
+	}
+	if p.puts != 0 {
+		t.Error("an owned piece is put before it's written")
+	}
+	// write rest of the first piece, then the second
+	second := []byte("second")
+	for err = w.Write(second); errors.Is(err, ErrPending); err = w.Write(second) {
+		if !isTimeout(err) {
+			t.Fatal("ErrPending doesn't wrap the timeout:", err)
+		}
+	}
+	for ; isTimeout(err); err = w.Flush() {
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.puts != 2 {
+		t.Errorf("wrong puts, want 2, got %d", p.puts)
+	}
+	r, _ := NewReader(buf, nil)
+	for _, want := range []string{"first", "second"} {
+		if p, err := r.Read(); err != nil || string(p) != want {
+			t.Errorf("unexpected result: %q, %v", p, err)
+		}
+	}
+}
+
+// next timeouts don't copy the payload again
+func Test_writer_timeout_copy_once(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(&timeoutWriter{w: buf}, &Config{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wr := w.(*writer)
+	piece := []byte("Hello, Lend!")
+	err = w.WriteBorrowed(piece)
+	copy(piece, "xxxxx") // the payload is copied
+	rest := wr.rest[:len(piece)]
+	for ; isTimeout(err); err = w.Flush() {
+		var last []byte
+		for _, b := range wr.bufs[wr.bufi:] {
+			if len(b) > 0 {
+				last = b
+			}
+		}
+		if len(last) > 0 && &last[len(last)-1] != &rest[len(rest)-1] {
+			t.Fatal("the payload is copied again")
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := NewReader(buf, nil)
+	if p, err := r.Read(); err != nil || string(p) != "Hello, Lend!" {
+		t.Errorf("unexpected result: %q, %v", p, err)
+	}
+}
+
+// a reused buffer is not a retry
+func Test_writer_timeout_reuse(t *testing.T) {
+	c := &Config{MaxSize: 100, Checksum: true}
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(&timeoutWriter{w: buf}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("msg-1")
+	if err := w.WriteBorrowed(msg); !isTimeout(err) {
+		t.Fatal("wrong error, want timeout, got:", err)
+	}
+	copy(msg, "msg-2")
+	for err = w.WriteBorrowed(msg); errors.Is(err, ErrPending); err = w.WriteBorrowed(msg) {
+	}
+	copy(msg, "msg-3") // the rest of the msg-2 is copied
+	for ; isTimeout(err); err = w.Flush() {
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := NewReader(buf, c)
+	for _, want := range []string{"msg-1", "msg-2"} {
+		if p, err := r.Read(); err != nil || string(p) != want {
+			t.Errorf("unexpected result: %q, %v", p, err)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func Test_reader_broken(t *testing.T) {
+	buf := writePieces(t, "Hello, Lend!")
+	buf.Truncate(buf.Len() - 1)
+	r, err := NewReader(buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal("wrong error, want io.ErrUnexpectedEOF, got:", err)
+	}
+	if !errors.Is(r.Err(), io.ErrUnexpectedEOF) {
+		t.Error("wrong Err, want io.ErrUnexpectedEOF, got:", r.Err())
+	}
+	for i := 0; i < 2; i++ {
+		_, err := r.Read()
+		if !errors.Is(err, ErrBroken) || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Error("wrong error, want ErrBroken, got:", err)
+		}
+	}
+	if _, _, err := r.NextReader(); !errors.Is(err, ErrBroken) {
+		t.Error("wrong error, want ErrBroken, got:", err)
+	}
+}
+
+func Test_reader_broken_size_limit(t *testing.T) {
+	buf := writePieces(t, "too large piece", "ok")
+	r, _ := NewReader(buf, &Config{MaxSize: 5})
+	if _, err := r.Read(); !errors.Is(err, ErrSizeLimit) {
+		t.Fatal("wrong error, want ErrSizeLimit, got:", err)
+	}
+	if _, err := r.Read(); !errors.Is(err, ErrBroken) {
+		t.Error("wrong error, want ErrBroken, got:", err)
+	}
+}
+
+func Test_reader_not_broken(t *testing.T) {
+	// clean EOF
+	r, _ := NewReader(new(bytes.Buffer), nil)
+	for i := 0; i < 2; i++ {
+		if _, err := r.Read(); err != io.EOF {
+			t.Error("wrong error, want io.EOF, got:", err)
+		}
+	}
+	// error before a frame
+	r, _ = NewReader(errorReader{}, nil)
+	r.Read()
+	if r.Err() != nil {
+		t.Error("broken by error before a frame:", r.Err())
+	}
+	// skipped piece
+	buf := writePieces(t, "too large piece", "ok")
+	r, _ = NewReader(buf, &Config{MaxSize: 5, SkipOversize: true})
+	r.Read()
+	if p, err := r.Read(); err != nil || string(p) != "ok" {
+		t.Errorf("unexpected result: %q, %v", p, err)
+	}
+	// lossy stream
+	c := &Config{MaxSize: 100, Heading: []byte("HEAD"), Checksum: true}
+	buf = new(bytes.Buffer)
+	w, _ := NewWriter(buf, c)
+	w.Write([]byte("Hello, Lend!"))
+	buf.Truncate(buf.Len() - 1)
+	w.Write([]byte("next"))
+	if r, err := NewReader(buf, c); err != nil {
+		t.Fatal(err)
+	} else if p, err := r.Read(); err != nil || string(p) != "next" {
+		t.Errorf("unexpected result: %q, %v", p, err)
+	}
+}
+
+func Test_writer_broken(t *testing.T) {
+	var swe secondWriteErr
+	w, err := NewWriter(&swe, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(largePiece); err == nil {
+		t.Fatal("missing error")
+	}
+	if w.Err() == nil {
+		t.Fatal("the Writer is not broken")
+	}
+	if err := w.Write([]byte("next")); !errors.Is(err, ErrBroken) {
+		t.Error("wrong error, want ErrBroken, got:", err)
+	}
+	if _, err := w.NextWriter(1); !errors.Is(err, ErrBroken) {
+		t.Error("wrong error, want ErrBroken, got:", err)
+	}
+}
+
+func Test_writer_not_broken(t *testing.T) {
+	// nothing is written
+	w, _ := NewWriter(errorWriter{}, nil)
+	w.Write([]byte("piece"))
+	if w.Err() != nil {
+		t.Error("broken by error before a frame:", w.Err())
+	}
+	// lossy stream
+	var swe secondWriteErr
+	w, _ = NewWriter(&swe, &Config{MaxSize: 100, Heading: []byte("HEAD")})
+	w.Write([]byte("piece"))
+	if w.Err() != nil {
+		t.Error("broken Writer with a Heading:", w.Err())
+	}
+	// size limit
+	w, _ = NewWriter(new(bytes.Buffer), &Config{MaxSize: 1})
+	w.Write([]byte("piece"))
+	if w.Err() != nil {
+		t.Error("broken by ErrSizeLimit:", w.Err())
+	}
+}
+
+func Test_reader_frame_error(t *testing.T) {
+	buf := writePieces(t, "one", "two", "three")
+	size := buf.Len()
+	buf.Truncate(size - 2)
+	r, _ := NewReader(buf, nil)
+	r.Read()
+	r.Read()
+	_, err := r.Read()
+	var fe *FrameError
+	if !errors.As(err, &fe) {
+		t.Fatal("wrong error, want *FrameError, got:", err)
+	}
+	want := FrameError{Frame: 2, Offset: int64(size - 2), Stage: StagePayload,
+		Length: 5, Err: io.ErrUnexpectedEOF}
+	if *fe != want {
+		t.Errorf("wrong *FrameError, want %+v, got %+v", want, *fe)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("*FrameError is not io.ErrUnexpectedEOF")
+	}
+	// size limit
+	r, _ = NewReader(writePieces(t, "too large piece"), &Config{MaxSize: 5})
+	_, err = r.Read()
+	if !errors.As(err, &fe) || !errors.Is(err, ErrSizeLimit) {
+		t.Fatal("wrong error, want *FrameError, got:", err)
+	}
+	if fe.Stage != StageLength || fe.Length != 15 || fe.Offset != 4 {
+		t.Errorf("wrong *FrameError: %+v", *fe)
+	}
+	// checksum
+	buf = new(bytes.Buffer)
+	w, _ := NewWriter(buf, &Config{MaxSize: 100, Checksum: true})
+	w.Write([]byte("corrupted"))
+	buf.Bytes()[5] ^= 0xff
+	r, _ = NewReader(buf, &Config{MaxSize: 100, Checksum: true})
+	_, err = r.Read()
+	if !errors.As(err, &fe) || fe.Stage != StageChecksum {
+		t.Error("wrong error, want *FrameError at checksum, got:", err)
+	}
+}
+
+func Test_reader_clean_eof(t *testing.T) {
+	for _, c := range []*Config{
+		nil,
+		{MaxSize: 100, Varint: true},
+		{MaxSize: 100, Heading: []byte("HEAD")},
+	} {
+		buf := new(bytes.Buffer)
+		w, _ := NewWriter(buf, c)
+		w.Write([]byte("piece"))
+		r, _ := NewReader(buf, c)
+		r.Read()
+		if _, err := r.Read(); err != io.EOF {
+			t.Errorf("%+v: wrong error, want io.EOF, got: %v", c, err)
+		}
+	}
+}
+
+func TestFrameError_Error(t *testing.T) {
+	err := &FrameError{Frame: 1, Offset: 10, Stage: StagePayload, Length: 5,
+		Err: io.ErrUnexpectedEOF}
+	want := "frame 1 at offset 10, payload (length 5): unexpected EOF"
+	if err.Error() != want {
+		t.Errorf("wrong message, want %q, got %q", want, err.Error())
+	}
+	if s := Stage(10).String(); s != "Stage(10)" {
+		t.Error("wrong name of unknown stage:", s)
+	}
+}
+
+func Test_reader_release(t *testing.T) {
+	p, b := new(maxPool), NewBudget(100)
+	buf := writePieces(t, "Hello, Lend!", "", "Bye")
+	r, err := NewReader(buf, &Config{MaxSize: 100, Pool: p, Budget: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		piece, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Release(piece)
+	}
+	r.Release(nil)
+	if p.gets != 3 || p.puts != 3 {
+		t.Errorf("wrong gets and puts: %d, %d", p.gets, p.puts)
+	}
+	if b.Used() != 0 {
+		t.Error("budget is not released:", b.Used())
+	}
+}
+
+func Test_reader_release_on_error(t *testing.T) {
+	p := new(maxPool)
+	buf := writePieces(t, "Hello, Lend!")
+	buf.Truncate(buf.Len() - 1)
+	r, _ := NewReader(buf, &Config{MaxSize: 100, Pool: p})
+	if piece, err := r.Read(); err == nil || piece != nil {
+		t.Fatalf("unexpected result: %q, %v", piece, err)
+	}
+	if p.gets != 1 || p.puts != 1 {
+		t.Errorf("the piece is not put back: %d gets, %d puts", p.gets, p.puts)
+	}
+}
+
+// countWriter counts Write calls
+type countWriter struct {
+	w      io.Writer
+	writes int
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.w.Write(p)
+}
+
+func Test_writer_single_write(t *testing.T) {
+	c := &Config{MaxSize: 2 * coalesceMax, Heading: []byte("HEAD"),
+		Checksum: true, Varint: true}
+	buf := new(bytes.Buffer)
+	cw := &countWriter{w: buf}
+	w, _ := NewWriter(cw, c)
+	w.Write([]byte("small piece"))
+	if cw.writes != 1 {
+		t.Error("wrong number of writes for small piece:", cw.writes)
+	}
+	w.Write(largePiece)
+	if cw.writes != 4 { // header, payload and checksum
+		t.Error("wrong number of writes for large piece:", cw.writes)
+	}
+	r, _ := NewReader(buf, c)
+	if p, err := r.Read(); err != nil || string(p) != "small piece" {
+		t.Errorf("unexpected result: %q, %v", p, err)
+	}
+	if p, err := r.Read(); err != nil || !bytes.Equal(p, largePiece) {
+		t.Errorf("unexpected result: %d bytes, %v", len(p), err)
+	}
+}
+
+// tcpPair returns connected TCP connections
+func tcpPair(tb testing.TB) (client, server net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	if client, err = net.Dial("tcp", l.Addr().String()); err != nil {
+		tb.Fatal(err)
+	}
+	if server, err = l.Accept(); err != nil {
+		tb.Fatal(err)
+	}
+	return
+}
+
+func Test_writer_vectored(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	c := &Config{MaxSize: 2 * coalesceMax, Checksum: true}
+	w, _ := NewWriter(client, c)
+	if !w.(*writer).vectored {
+		t.Fatal("writev is not used for a TCP connection")
+	}
+	go func() {
+		w.Write([]byte("small piece"))
+		w.Write(largePiece)
+	}()
+	r, _ := NewReader(server, c)
+	if p, err := r.Read(); err != nil || string(p) != "small piece" {
+		t.Errorf("unexpected result: %q, %v", p, err)
+	}
+	if p, err := r.Read(); err != nil || !bytes.Equal(p, largePiece) {
+		t.Errorf("unexpected result: %d bytes, %v", len(p), err)
+	}
+}
+
+func benchmarkWriter(b *testing.B, w io.Writer, c *Config) {
+	cw := &countWriter{w: w}
+	lw, _ := NewWriter(cw, c)
+	piece := []byte("small piece of data")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := lw.Write(piece); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(cw.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkWriter_Write(b *testing.B) {
+	benchmarkWriter(b, io.Discard, &Config{MaxSize: 100, Checksum: true})
+}
+
+func BenchmarkWriter_Write_tcp(b *testing.B) {
+	client, server := tcpPair(b)
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+	benchmarkWriter(b, client, &Config{MaxSize: 100, Checksum: true})
+}
+
+func BenchmarkWriter_Write_writev(b *testing.B) {
+	client, server := tcpPair(b)
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+	w, _ := NewWriter(client, &Config{MaxSize: 2 * coalesceMax,
+		Checksum: true})
+	b.ReportAllocs()
+	b.SetBytes(int64(len(largePiece)))
+	for i := 0; i < b.N; i++ {
+		if err := w.Write(largePiece); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
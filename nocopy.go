@@ -0,0 +1,189 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// kinds of memory of a part of a piece
+const (
+	partPool    = iota // from a Pool, charged in a Budget
+	partScratch        // internal buffer of a Reader
+	partInto           // buffer given to the ReadInto
+)
+
+// adopt moves read part of a piece to memory of given
+// kind; the buf is the buffer of the ReadInto
+func (r *reader) adopt(kind int, buf []byte) (err error) {
+	if r.part == nil && kind != partInto {
+		r.kind = kind
+		return
+	}
+	if r.kind == kind && (kind != partInto || same(r.part, buf)) {
+		return
+	}
+	var part []byte
+	switch kind {
+	case partPool:
+		if r.overBudget() {
+			return ErrBudgetLimit
+		}
+		if err = r.acquire(r.partn); err != nil {
+			return
+		}
+		part = r.get(r.partn)
+	case partScratch:
+		if cap(r.scratch) < len(r.part) {
+			r.scratch = make([]byte, len(r.part))
+		}
+		part = r.scratch[:len(r.part)]
+	default:
+		part = buf
+	}
+	partn := r.partn
+	copy(part, r.part[:partn])
+	r.dropPart()
+	r.part, r.partn, r.kind = part, partn, kind
+	if kind == partPool {
+		r.held = partn
+	}
+	return
+}
+
+// ReadInto reads next piece into given buffer and returns
+// its size. If the buffer is too small, then the ReadInto
+// returns io.ErrShortBuffer and size of the piece, and the
+// piece is not lost. Call the ReadInto again with a larger
+// buffer. After a timeout, call it with the same buffer. A
+// chunked piece is read into an internal buffer and then
+// it's copied. The ReadInto doesn't use a Pool or a Budget.
+func (r *reader) ReadInto(buf []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, broken(r.err)
+	}
+	if err = r.drain(); err != nil {
+		return
+	}
+	var piece []byte
+	for {
+		if err = r.readHeader(); err != nil {
+			return
+		}
+		if !r.more && (r.stage == stagePayload ||
+			r.kind == partInto && r.part != nil) {
+			// the size is known, read the piece directly
+			if n = r.partn + r.plen; n > len(buf) {
+				return n, io.ErrShortBuffer
+			}
+			r.adopt(partInto, buf[:n])
+		} else {
+			r.adopt(partScratch, nil)
+		}
+		if piece, err = r.read(); err != nil {
+			if r.resync(err) {
+				continue // wrong position, skip the frame
+			}
+			return 0, err
+		}
+		if n = len(piece); n > len(buf) {
+			return n, io.ErrShortBuffer // keep the piece
+		}
+		copy(buf, r.take()) // no-op for the partInto
+		return
+	}
+}
+
+// ReadNoCopy reads next piece. The piece is a slice of an
+// internal buffer of the Reader, and it's valid until next
+// call of the Reader. Don't modify or Release it. Pieces
+// that don't fit the buffer, and chunked pieces, are read
+// into another internal buffer. The ReadNoCopy doesn't use
+// a Pool or a Budget.
+func (r *reader) ReadNoCopy() (piece []byte, err error) {
+	if r.err != nil {
+		return nil, broken(r.err)
+	}
+	if err = r.drain(); err != nil {
+		return
+	}
+	for {
+		if err = r.readHeader(); err != nil {
+			return
+		}
+		if r.stage == stagePayload && r.partn == 0 && !r.more {
+			piece, err = r.peek()
+		} else {
+			r.adopt(partScratch, nil)
+			if piece, err = r.read(); err == nil {
+				piece = r.take()
+			}
+		}
+		if err != nil && r.resync(err) {
+			continue // wrong position, skip the frame
+		}
+		return
+	}
+}
+
+// peek returns a piece and its checksum from the
+// buffer of the Reader, if they fit it; otherwise
+// the piece is read into the scratch buffer
+func (r *reader) peek() (piece []byte, err error) {
+	n := r.plen
+	if r.checksum {
+		n += len(r.sumb)
+	}
+	if n > r.br.Size() {
+		r.adopt(partScratch, nil)
+		if piece, err = r.read(); err == nil {
+			piece = r.take()
+		}
+		return
+	}
+	r.dropPart() // empty part after a timeout
+	var buf []byte
+	if buf, err = r.br.Peek(n); err != nil {
+		return nil, r.fail(unexpectedEOF(err)) // nothing is discarded
+	}
+	piece = buf[:r.plen:r.plen]
+	r.br.Discard(n)
+	r.off += int64(n)
+	if r.checksum && binary.BigEndian.Uint32(buf[r.plen:]) !=
+		crc32.Checksum(piece, castagnoli) {
+		r.stage = stageChecksum
+		err = r.frameError(StageChecksum, ErrChecksum)
+		r.part, r.partn, r.kind = piece, r.plen, partScratch
+		r.sumn = copy(r.sumb[:], buf[r.plen:])
+		r.rescan() // before next read of the buffer
+		r.reset()  // garbage
+		return nil, err
+	}
+	r.reset()
+	return
+}
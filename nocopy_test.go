@@ -0,0 +1,269 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+var noCopyConfigs = []*Config{
+	{MaxSize: 10000},
+	{MaxSize: 10000, Varint: true, Checksum: true},
+	{MaxSize: 10000, Heading: []byte("HEAD"), Checksum: true},
+	{MaxSize: 10000, Chunked: true, Incremental: true},
+}
+
+var noCopyPieces = []string{"one", "", strings.Repeat("x", 5000), "two"}
+
+// writeNoCopyPieces writes the noCopyPieces using given
+// config; it writes chunked pieces for the Chunked
+func writeNoCopyPieces(t *testing.T, c *Config) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range noCopyPieces {
+		if !c.Chunked {
+			if err := w.Write([]byte(p)); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		pw, err := w.NextWriter(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(p); i += 1000 {
+			pw.Write([]byte(p[i:min(i+1000, len(p))]))
+		}
+		if err := pw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf
+}
+
+func TestReader_ReadInto(t *testing.T) {
+	for _, c := range noCopyConfigs {
+		r, _ := NewReader(writeNoCopyPieces(t, c), c)
+		for _, want := range noCopyPieces {
+			buf := make([]byte, 3)
+			n, err := r.ReadInto(buf)
+			if len(want) > len(buf) {
+				if err != io.ErrShortBuffer || n != len(want) {
+					t.Fatalf("want short buffer error and %d, got %v, %d",
+						len(want), err, n)
+				}
+				buf = make([]byte, n)
+				n, err = r.ReadInto(buf)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != want {
+				t.Errorf("wrong piece, want %d bytes, got %d", len(want), n)
+			}
+		}
+		if _, err := r.ReadInto(nil); err != io.EOF {
+			t.Error("wrong error, want io.EOF, got:", err)
+		}
+	}
+}
+
+func TestReader_ReadInto_short_Read(t *testing.T) {
+	for _, c := range noCopyConfigs {
+		r, _ := NewReader(writeNoCopyPieces(t, c), c)
+		for _, want := range noCopyPieces {
+			if _, err := r.ReadInto(nil); len(want) > 0 &&
+				err != io.ErrShortBuffer {
+				t.Fatal("wrong error:", err)
+			}
+			if len(want) == 0 {
+				continue // read by the ReadInto
+			}
+			p, err := r.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(p) != want {
+				t.Errorf("wrong piece, want %d bytes, got %d", len(want),
+					len(p))
+			}
+		}
+	}
+}
+
+func TestReader_ReadInto_timeout(t *testing.T) {
+	for _, c := range append(testConfigs(nil), noCopyConfigs...) {
+		buf := new(bytes.Buffer)
+		w, _ := NewWriter(buf, &Config{MaxSize: c.MaxSize, Varint: c.Varint,
+			Heading: c.Heading, Checksum: c.Checksum})
+		pieces := []string{"Hello, Lend!", "", "Bye"}
+		for _, p := range pieces {
+			w.Write([]byte(p))
+		}
+		r, _ := NewReader(&timeoutReader{r: buf}, c)
+		b := make([]byte, 100)
+		for _, want := range pieces {
+			n, err := r.ReadInto(b)
+			for ; isTimeout(err); n, err = r.ReadInto(b) {
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b[:n]) != want {
+				t.Errorf("wrong piece, want %q, got %q", want, b[:n])
+			}
+		}
+	}
+}
+
+func TestReader_ReadNoCopy(t *testing.T) {
+	for _, c := range noCopyConfigs {
+		r, _ := NewReader(writeNoCopyPieces(t, c), c)
+		for _, want := range noCopyPieces {
+			p, err := r.ReadNoCopy()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(p) != want {
+				t.Errorf("wrong piece, want %d bytes, got %d", len(want),
+					len(p))
+			}
+		}
+		if _, err := r.ReadNoCopy(); err != io.EOF {
+			t.Error("wrong error, want io.EOF, got:", err)
+		}
+	}
+}
+
+func TestReader_ReadNoCopy_timeout(t *testing.T) {
+	for _, c := range testConfigs(nil) {
+		buf := new(bytes.Buffer)
+		w, _ := NewWriter(buf, &Config{MaxSize: c.MaxSize, Varint: c.Varint,
+			Heading: c.Heading, Checksum: c.Checksum})
+		pieces := []string{"Hello, Lend!", "", "Bye"}
+		for _, p := range pieces {
+			w.Write([]byte(p))
+		}
+		r, _ := NewReader(&timeoutReader{r: buf}, c)
+		for i, want := range pieces {
+			var p []byte
+			var err error
+			if i == 0 {
+				p, err = r.Read() // mix them
+			} else {
+				p, err = r.ReadNoCopy()
+			}
+			for ; isTimeout(err); p, err = r.ReadNoCopy() {
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(p) != want {
+				t.Errorf("wrong piece, want %q, got %q", want, p)
+			}
+		}
+	}
+}
+
+func TestReader_ReadNoCopy_checksum(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, &Config{MaxSize: 100, Checksum: true})
+	w.Write([]byte("piece"))
+	w.Write([]byte("next"))
+	b := buf.Bytes()
+	b[6]++ // corrupt the piece
+	r, _ := NewReader(buf, &Config{MaxSize: 100, Checksum: true})
+	if _, err := r.ReadNoCopy(); !errors.Is(err, ErrChecksum) {
+		t.Error("wrong error, want ErrChecksum, got:", err)
+	}
+	if p, err := r.ReadNoCopy(); err != nil || string(p) != "next" {
+		t.Errorf("wrong piece %q or error: %v", p, err)
+	}
+}
+
+func TestReader_no_allocs(t *testing.T) {
+	const runs = 100
+	for name, read := range map[string]func(r FrameReader, b []byte) error{
+		"ReadInto": func(r FrameReader, b []byte) (err error) {
+			_, err = r.ReadInto(b)
+			return
+		},
+		"ReadNoCopy": func(r FrameReader, _ []byte) (err error) {
+			_, err = r.ReadNoCopy()
+			return
+		},
+	} {
+		pieces := make([]string, runs+1)
+		for i := range pieces {
+			pieces[i] = "small piece"
+		}
+		r, _ := NewReader(writePieces(t, pieces...), nil)
+		b := make([]byte, 100)
+		allocs := testing.AllocsPerRun(runs, func() {
+			if err := read(r, b); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("%s allocates: %v", name, allocs)
+		}
+	}
+}
+
+func TestReader_ReadInto_short_NextReader(t *testing.T) {
+	c := &Config{MaxSize: 10000, Chunked: true, Checksum: true}
+	r, _ := NewReader(writeNoCopyPieces(t, c), c)
+	for _, want := range noCopyPieces {
+		if _, err := r.ReadInto(nil); len(want) > 0 &&
+			err != io.ErrShortBuffer {
+			t.Fatal("wrong error:", err)
+		}
+		if len(want) == 0 {
+			continue // read by the ReadInto
+		}
+		pr, _, err := r.NextReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := io.ReadAll(pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != want {
+			t.Errorf("wrong piece, want %d bytes, got %d", len(want), len(p))
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Error("wrong error, want io.EOF, got:", err)
+	}
+}
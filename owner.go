@@ -0,0 +1,93 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"unsafe"
+)
+
+// borrowedMax is number of recently borrowed
+// pieces remembered by the DebugOwnership
+const borrowedMax = 1024
+
+// borrowed pieces registry
+var borrowed borrowRegistry
+
+// borrowedPiece is a borrowed piece and stack
+// trace of the call that borrowed it
+type borrowedPiece struct {
+	piece []byte
+	stack []byte
+}
+
+// borrowRegistry keeps recently borrowed pieces; it
+// holds the pieces, thus their memory can't be reused
+type borrowRegistry struct {
+	mu     sync.Mutex
+	pieces [borrowedMax]borrowedPiece
+	n      int // next index
+}
+
+// span returns memory range of given slice
+// including its capacity
+func span(b []byte) (start, end uintptr) {
+	start = uintptr(unsafe.Pointer(unsafe.SliceData(b)))
+	return start, start + uintptr(cap(b))
+}
+
+// add remembers given piece
+func (b *borrowRegistry) add(piece []byte) {
+	if cap(piece) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pieces[b.n] = borrowedPiece{piece, debug.Stack()}
+	b.n = (b.n + 1) % borrowedMax
+}
+
+// check panics if given slice shares memory
+// with a borrowed piece
+func (b *borrowRegistry) check(piece []byte) {
+	if cap(piece) == 0 {
+		return
+	}
+	start, end := span(piece)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, bp := range b.pieces {
+		if bp.piece == nil {
+			continue
+		}
+		if bs, be := span(bp.piece); start < be && bs < end {
+			panic(fmt.Sprintf("lend: borrowed piece %p is in a Pool,"+
+				" borrowed at:\n%s", unsafe.SliceData(bp.piece), bp.stack))
+		}
+	}
+}
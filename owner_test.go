@@ -0,0 +1,168 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// forget borrowed pieces
+func resetBorrowed() {
+	borrowed.mu.Lock()
+	defer borrowed.mu.Unlock()
+	borrowed.pieces = [borrowedMax]borrowedPiece{}
+	borrowed.n = 0
+}
+
+func TestWriter_ownership(t *testing.T) {
+	p := new(maxPool)
+	w, err := NewWriter(new(bytes.Buffer), &Config{MaxSize: 100, Pool: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("owned"))
+	w.WriteOwned([]byte("owned"))
+	if p.puts != 2 {
+		t.Errorf("owned pieces are not put: %d", p.puts)
+	}
+	w.WriteBorrowed([]byte("borrowed"))
+	if p.puts != 2 {
+		t.Error("borrowed piece is put to the Pool")
+	}
+	w, _ = NewWriter(new(bytes.Buffer), &Config{MaxSize: 100, Pool: p,
+		Borrowed: true})
+	w.Write([]byte("borrowed"))
+	if p.puts != 2 {
+		t.Error("borrowed piece is put to the Pool")
+	}
+	w.WriteOwned([]byte("owned"))
+	if p.puts != 3 {
+		t.Error("owned piece is not put to the Pool")
+	}
+}
+
+func TestPacketWriter_borrowed(t *testing.T) {
+	src, dst := listenPacket(t), listenPacket(t)
+	defer src.Close()
+	defer dst.Close()
+	p := new(maxPool)
+	w, err := NewPacketWriter(src, &Config{MaxSize: 100, Pool: p,
+		Borrowed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTo([]byte("borrowed"), dst.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if p.puts != 0 {
+		t.Error("borrowed piece is put to the Pool")
+	}
+}
+
+// mustPanic calls given function and checks that it
+// panics with a message that contains given string
+func mustPanic(t *testing.T, msg string, f func()) {
+	t.Helper()
+	defer func() {
+		if e := recover(); e == nil {
+			t.Error("missing panic")
+		} else if s, _ := e.(string); !strings.Contains(s, msg) {
+			t.Error("wrong panic:", e)
+		}
+	}()
+	f()
+}
+
+func TestWriter_debug_ownership(t *testing.T) {
+	defer resetBorrowed()
+	c := &Config{MaxSize: 100, Pool: dummyPool{}, DebugOwnership: true}
+	w, err := NewWriter(new(bytes.Buffer), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	other := make([]byte, 10)
+	if err := w.WriteBorrowed(buf[2:4]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteOwned(other); err != nil {
+		t.Fatal(err) // no panic
+	}
+	mustPanic(t, "borrowed at", func() { w.WriteOwned(buf[:1]) })
+}
+
+// pieces borrowed by the Borrowed option are remembered
+func TestWriter_debug_ownership_config(t *testing.T) {
+	defer resetBorrowed()
+	c := &Config{MaxSize: 100, Pool: dummyPool{}, Borrowed: true,
+		DebugOwnership: true}
+	w, err := NewWriter(new(bytes.Buffer), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, batch := make([]byte, 10), make([]byte, 10)
+	if err := w.Write(buf[:4]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteBatch([][]byte{batch[:2]}); err != nil {
+		t.Fatal(err)
+	}
+	mustPanic(t, "borrowed at", func() { w.WriteOwned(buf[:1]) })
+	mustPanic(t, "borrowed at", func() { w.WriteOwned(batch[5:]) })
+	src, dst := listenPacket(t), listenPacket(t)
+	defer src.Close()
+	defer dst.Close()
+	pw, err := NewPacketWriter(src, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagram := make([]byte, 10)
+	if err := pw.WriteTo(datagram[:3], dst.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	mustPanic(t, "borrowed at", func() { w.WriteOwned(datagram) })
+}
+
+type constPool []byte
+
+func (c constPool) Get(size int) []byte { return c[:size] }
+func (c constPool) Put([]byte)          {}
+
+func TestReader_debug_ownership(t *testing.T) {
+	defer resetBorrowed()
+	buf := make([]byte, 100)
+	w, _ := NewWriter(new(bytes.Buffer), &Config{MaxSize: 100,
+		DebugOwnership: true})
+	w.WriteBorrowed(buf)
+	r, err := NewReader(writePieces(t, "piece"), &Config{MaxSize: 100,
+		Pool: constPool(buf), DebugOwnership: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPanic(t, "borrowed at", func() { r.Read() })
+}
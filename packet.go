@@ -0,0 +1,221 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+)
+
+// maxPacketSize is max size of a datagram
+// that a PacketReader can receive
+const maxPacketSize = 1<<16 - 1
+
+// ErrMalformedPacket occurs when a datagram is shorter
+// or longer than its heading and length declare.
+var ErrMalformedPacket = errors.New("malformed packet")
+
+// A PacketReader represents an interface that reads
+// a data, piece by piece, from a datagram network.
+// Each datagram keeps exactly one piece. Both,
+// PacketReader and PacketWriter should have the
+// same configs MaxSize, Heading and Varint. The
+// Release puts a piece back to a Pool when it's
+// no longer used.
+type PacketReader interface {
+	ReadFrom() (piece []byte, addr net.Addr, err error)
+	Release(piece []byte)
+}
+
+// A PacketWriter represents an interface that
+// writes a data, piece by piece, to a datagram
+// network. Each piece is sent as one datagram.
+type PacketWriter interface {
+	WriteTo(piece []byte, addr net.Addr) (err error)
+}
+
+type packetReader struct {
+	pc net.PacketConn
+	base
+	buf []byte // datagram buffer
+}
+
+// NewPacketReader creates PacketReader interface over
+// given net.PacketConn using given *Config. If *Config
+// is nil then DefaultConfig() is used. Error indicates
+// that *Config is incorrect. A datagram can't be larger
+// then 64KiB, thus there is no reason to use MaxSize
+// greater than 64KiB. Unlike a Reader, the PacketReader
+// never looks for a Heading inside a datagram. A datagram
+// must starts with it. Datagrams that doesn't will be
+// skipped. And if a Heading is given, then all malformed
+// datagrams will be skipped too. Otherwise, ErrSizeLimit,
+// ErrNegativeLength, ErrChecksum or ErrMalformedPacket will
+// be returned with address of the datagram. Such errors doesn't
+// break the PacketReader.
+func NewPacketReader(pc net.PacketConn, c *Config) (PacketReader, error) {
+	if c == nil {
+		c = DefaultConfig()
+	}
+	if err := c.Check(); err != nil {
+		return nil, err
+	}
+	q := new(packetReader)
+	q.pc = pc
+	q.init(c)
+	size := len(q.heading) + q.lenSize()
+	if q.checksum {
+		size += len(q.sumb)
+	}
+	if c.MaxSize > maxPacketSize-size {
+		size = maxPacketSize
+	} else {
+		size += c.MaxSize
+	}
+	q.buf = make([]byte, size)
+	return q, nil
+}
+
+// parse datagram and return payload
+func (p *packetReader) parse(dg []byte) (payload []byte, err error) {
+	if !bytes.HasPrefix(dg, p.heading) {
+		err = ErrMalformedPacket
+		return
+	}
+	dg = dg[len(p.heading):]
+	var l, n int
+	if l, n, err = p.parseLen(dg); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrMalformedPacket
+		}
+		return
+	}
+	if payload = dg[n:]; p.checksum {
+		if len(payload) != l+len(p.sumb) {
+			err = ErrMalformedPacket
+			return
+		}
+		if !bytes.Equal(payload[l:], p.sum(payload[:l])) {
+			err = ErrChecksum
+			return
+		}
+		payload = payload[:l]
+	}
+	if len(payload) != l {
+		err = ErrMalformedPacket
+	}
+	return
+}
+
+// ReadFrom reads next datagram and returns piece
+// of data and address of sender. If a Budget is
+// exhausted, then the datagram is dropped.
+func (p *packetReader) ReadFrom() (piece []byte, addr net.Addr, err error) {
+	for {
+		var n int
+		if n, addr, err = p.pc.ReadFrom(p.buf); err != nil {
+			return
+		}
+		var payload []byte
+		if payload, err = p.parse(p.buf[:n]); err != nil {
+			if len(p.heading) > 0 {
+				continue // skip malformed datagram
+			}
+			return
+		}
+		if err = p.acquire(len(payload)); err != nil {
+			return
+		}
+		piece = p.get(len(payload))
+		copy(piece, payload)
+		return
+	}
+}
+
+type packetWriter struct {
+	pc net.PacketConn
+	base
+	buf []byte // datagram buffer
+}
+
+// NewPacketWriter creates PacketWriter interface over
+// given net.PacketConn using given *Config. If *Config
+// is nil then DefaultConfig() is used. Error indicates
+// that *Config is incorrect. If a Pool is given then
+// each WriteTo automatically puts a piece of data
+// to the Pool, unless the Borrowed option is set.
+// But if any error occurs during writing then the
+// piece will not be put to the Pool.
+func NewPacketWriter(pc net.PacketConn, c *Config) (PacketWriter, error) {
+	if c == nil {
+		c = DefaultConfig()
+	}
+	if err := c.Check(); err != nil {
+		return nil, err
+	}
+	q := new(packetWriter)
+	q.pc = pc
+	q.init(c)
+	q.lenb = make([]byte, q.lenSize())
+	return q, nil
+}
+
+// WriteTo writes given piece to given address as
+// one datagram. If given address is nil and the
+// net.PacketConn is connected (e.g. created by
+// net.DialUDP) then the datagram is written
+// using its Write method. If a length of the
+// piece exceeds a size limit then ErrSizeLimit
+// is returned.
+func (p *packetWriter) WriteTo(piece []byte, addr net.Addr) (err error) {
+	if p.debug && p.borrowed {
+		borrowed.add(piece)
+	}
+	if len(piece) > p.max {
+		err = ErrSizeLimit
+		return
+	}
+	p.buf = append(p.buf[:0], p.heading...)
+	p.buf = append(p.buf, p.putLen(len(piece))...)
+	p.buf = append(p.buf, piece...)
+	if p.checksum {
+		p.buf = append(p.buf, p.sum(piece)...)
+	}
+	if w, ok := p.pc.(io.Writer); ok && addr == nil {
+		_, err = w.Write(p.buf)
+	} else {
+		_, err = p.pc.WriteTo(p.buf, addr)
+	}
+	if err != nil {
+		return
+	}
+	if !p.borrowed {
+		p.put(piece)
+	}
+	return
+}
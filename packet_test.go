@@ -0,0 +1,316 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenPacket(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("can't listen UDP:", err)
+	}
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	return pc
+}
+
+// join returns new slice that contains given
+// heading and bytes
+func join(heading []byte, b ...byte) []byte {
+	return append(append([]byte{}, heading...), b...)
+}
+
+func TestNewPacketReader_badConfigs(t *testing.T) {
+	if _, err := NewPacketReader(nil, &Config{MaxSize: -1}); err == nil {
+		t.Fatal("NewPacketReader with bad configs: missing error")
+	}
+}
+
+func TestNewPacketWriter_badConfigs(t *testing.T) {
+	if _, err := NewPacketWriter(nil, &Config{MaxSize: -1}); err == nil {
+		t.Fatal("NewPacketWriter with bad configs: missing error")
+	}
+}
+
+func TestNewPacketReader_bufferSize(t *testing.T) {
+	r, err := NewPacketReader(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(r.(*packetReader).buf); l != maxPacketSize {
+		t.Errorf("wrong buffer size: want %d, got %d", maxPacketSize, l)
+	}
+	r, err = NewPacketReader(nil, &Config{MaxSize: 10, Heading: []byte("HD")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(r.(*packetReader).buf); l != 2+4+10 {
+		t.Errorf("wrong buffer size: want %d, got %d", 2+4+10, l)
+	}
+}
+
+func testPacket(t *testing.T, c *Config) {
+	src, dst := listenPacket(t), listenPacket(t)
+	defer src.Close()
+	defer dst.Close()
+	w, err := NewPacketWriter(src, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewPacketReader(dst, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"Hello, Lend!", "", "Bye"} {
+		if err := w.WriteTo([]byte(msg), dst.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		p, addr, err := r.ReadFrom()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != msg {
+			t.Errorf("wrong value: want %q, got %q", msg, string(p))
+		}
+		if addr.String() != src.LocalAddr().String() {
+			t.Errorf("wrong address: want %s, got %s", src.LocalAddr(), addr)
+		}
+	}
+}
+
+func Test_packet_nil(t *testing.T) {
+	testPacket(t, nil)
+}
+
+func Test_packet_varint(t *testing.T) {
+	testPacket(t, &Config{MaxSize: 100, Varint: true})
+}
+
+func Test_packet_heading(t *testing.T) {
+	testPacket(t, &Config{MaxSize: 100, Heading: []byte("HEAD")})
+}
+
+func Test_packet_pool(t *testing.T) {
+	testPacket(t, &Config{MaxSize: 100, Pool: dummyPool{}})
+}
+
+func Test_packet_uint64(t *testing.T) {
+	if maxInt == maxInt32 {
+		t.Skip("platform depended test requires 64-bit int size")
+	}
+	testPacket(t, &Config{MaxSize: maxInt32 + 1})
+}
+
+func Test_packet_malformed(t *testing.T) {
+	src, dst := listenPacket(t), listenPacket(t)
+	defer src.Close()
+	defer dst.Close()
+	r, err := NewPacketReader(dst, &Config{MaxSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dg := range [][]byte{
+		{0, 0},                   // short length
+		{0, 0, 0, 3, 'a'},        // short piece
+		{0, 0, 0, 1, 'a', 'b'},   // long piece
+		{0, 0, 0, 6, 'a', 'b'},   // size limit
+		{0xff, 0xff, 0xff, 0xff}, // negative or size limit
+	} {
+		if _, err := src.WriteTo(dg, dst.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := r.ReadFrom(); err == nil {
+			t.Errorf("missing error for %v", dg)
+		}
+	}
+	// the reader is not broken
+	if _, err := src.WriteTo([]byte{0, 0, 0, 1, 'a'}, dst.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if p, _, err := r.ReadFrom(); err != nil {
+		t.Error("unexpected error:", err)
+	} else if string(p) != "a" {
+		t.Errorf("wrong value: want %q, got %q", "a", string(p))
+	}
+}
+
+func Test_packet_heading_skip(t *testing.T) {
+	src, dst := listenPacket(t), listenPacket(t)
+	defer src.Close()
+	defer dst.Close()
+	heading := []byte("HEAD")
+	r, err := NewPacketReader(dst, &Config{MaxSize: 5, Heading: heading})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dg := range [][]byte{
+		[]byte("garbage"),
+		join(heading, 0, 0, 0, 3, 'a'),
+		join(heading, 0, 0, 0, 6, 'a', 'b', 'c', 'd', 'e', 'f'),
+		join(heading, 0, 0, 0, 3, 'a', 'b', 'c'),
+	} {
+		if _, err := src.WriteTo(dg, dst.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p, _, err := r.ReadFrom(); err != nil {
+		t.Error("unexpected error:", err)
+	} else if string(p) != "abc" {
+		t.Errorf("wrong value: want %q, got %q", "abc", string(p))
+	}
+}
+
+func Test_packet_one_datagram(t *testing.T) {
+	src, dst := listenPacket(t), listenPacket(t)
+	defer src.Close()
+	defer dst.Close()
+	heading := []byte("HEAD")
+	w, err := NewPacketWriter(src, &Config{MaxSize: 5, Heading: heading})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTo([]byte("abc"), dst.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, _, err := dst.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := join(heading, 0, 0, 0, 3, 'a', 'b', 'c')
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("wrong datagram: want %v, got %v", want, buf[:n])
+	}
+}
+
+func Test_packet_connected(t *testing.T) {
+	dst := listenPacket(t)
+	defer dst.Close()
+	conn, err := net.DialUDP("udp", nil, dst.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	w, err := NewPacketWriter(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewPacketReader(dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTo([]byte("piece"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if p, _, err := r.ReadFrom(); err != nil {
+		t.Error("unexpected error:", err)
+	} else if string(p) != "piece" {
+		t.Errorf("wrong value: want %q, got %q", "piece", string(p))
+	}
+}
+
+func Test_packet_writer_big_piece(t *testing.T) {
+	w, err := NewPacketWriter(nil, &Config{MaxSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTo([]byte("I'm a big piece"), nil); err == nil {
+		t.Error("missing error for big piece")
+	}
+}
+
+func Test_packet_writer_err(t *testing.T) {
+	pc := listenPacket(t)
+	pc.Close()
+	w, err := NewPacketWriter(pc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTo([]byte("piece"), pc.LocalAddr()); err == nil {
+		t.Error("missing error")
+	}
+	r, err := NewPacketReader(pc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.ReadFrom(); err == nil {
+		t.Error("missing error")
+	}
+}
+
+func Test_packet_checksum(t *testing.T) {
+	testPacket(t, &Config{MaxSize: 100, Checksum: true})
+	testPacket(t, &Config{MaxSize: 100, Checksum: true, Varint: true})
+}
+
+func Test_packet_checksum_mismatch(t *testing.T) {
+	src, dst := listenPacket(t), listenPacket(t)
+	defer src.Close()
+	defer dst.Close()
+	r, err := NewPacketReader(dst, &Config{MaxSize: 5, Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for dg, want := range map[string]error{
+		"\x00\x00\x00\x01a\x00\x00\x00\x00": ErrChecksum,
+		"\x00\x00\x00\x01a\x00\x00\x00":     ErrMalformedPacket,
+	} {
+		if _, err := src.WriteTo([]byte(dg), dst.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := r.ReadFrom(); err != want {
+			t.Errorf("wrong error, want %v, got %v", want, err)
+		}
+	}
+}
+
+func Test_packet_release(t *testing.T) {
+	src, dst := listenPacket(t), listenPacket(t)
+	defer src.Close()
+	defer dst.Close()
+	p, b := new(maxPool), NewBudget(4)
+	c := &Config{MaxSize: 100, Pool: p, Budget: b}
+	w, _ := NewPacketWriter(src, &Config{MaxSize: 100})
+	r, err := NewPacketReader(dst, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"abc", "def"} {
+		w.WriteTo([]byte(msg), dst.LocalAddr())
+		piece, _, err := r.ReadFrom()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Release(piece)
+	}
+	if p.puts != 2 || b.Used() != 0 {
+		t.Errorf("pieces are not released: %d puts, %d used", p.puts, b.Used())
+	}
+}
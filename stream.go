@@ -0,0 +1,411 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// ErrPieceOpen occurs when a Writer used while a piece
+// writer, returned by NextWriter, is not written to end.
+var ErrPieceOpen = errors.New("previous piece is not finished")
+
+// pieceReader is bounded reader of a piece
+type pieceReader struct {
+	r     *reader
+	pre   []byte // already read bytes of the piece (Incremental)
+	part  []byte // slice of the pre to put to a Pool
+	n     int64  // unread bytes of the piece (or current chunk)
+	total int64  // size of the piece (or its chunks read so far)
+	crc   uint32 // checksum of read bytes
+	done  bool   // the checksum is read
+}
+
+// NextReader returns io.Reader of next piece and size of the
+// piece. The io.Reader returns io.EOF at the end of the piece.
+// If the Checksum option is set, then the io.Reader returns
+// ErrChecksum instead of io.EOF if checksum doesn't match.
+// The io.Reader is valid until next Read or NextReader call.
+// Unread rest of the piece will be discarded by the call.
+// The NextReader doesn't allocate a piece, thus a Pool and
+// a Budget are not used. For a chunked piece the size is -1
+// and the io.Reader returns ErrSizeLimit if the piece
+// exceeds the MaxSize.
+func (r *reader) NextReader() (_ io.Reader, size int64, err error) {
+	if r.err != nil {
+		return nil, 0, broken(r.err)
+	}
+	if err = r.drain(); err != nil {
+		return
+	}
+	if err = r.readHeader(); err != nil {
+		return
+	}
+	p := &pieceReader{r: r, n: int64(r.plen)}
+	p.total = int64(r.partn) + p.n
+	if size = p.total; r.more {
+		size = -1
+	}
+	if r.part != nil { // after budget error or timeout
+		if p.pre = r.part[:r.partn]; r.kind == partPool {
+			r.release(r.held)
+			p.part = r.part
+		}
+		r.part, r.partn, r.held = nil, 0, 0
+	}
+	p.done = r.stage == stageDone
+	r.stage, r.plen = stageStream, 0 // the frame belongs to p
+	r.cur = p
+	return p, size, nil
+}
+
+// drain discards unread rest of current piece
+func (r *reader) drain() (err error) {
+	p := r.cur
+	if p == nil {
+		return
+	}
+	p.putPart()
+	var m int64
+	for {
+		m, err = io.CopyN(io.Discard, r.r, p.n)
+		r.off += m
+		if p.n -= m; err != nil {
+			return p.fail(unexpectedEOF(err))
+		}
+		if !r.more {
+			break
+		}
+		if err = p.nextChunk(); err != nil {
+			if r.skippable(err) {
+				err = nil // the piece is skipped
+			}
+			return
+		}
+	}
+	if err = p.readSum(); err != nil {
+		return p.fail(err)
+	}
+	r.cur = nil
+	r.reset()
+	return
+}
+
+// readSum reads checksum of the piece, if it's not read yet
+func (p *pieceReader) readSum() error {
+	if p.done {
+		return nil
+	}
+	return p.r.readSum()
+}
+
+// fail drops the piece, unless given error is a timeout
+func (p *pieceReader) fail(err error) error {
+	return p.failAt(p.r.where(), err)
+}
+
+func (p *pieceReader) failAt(s Stage, err error) error {
+	if !isTimeout(err) {
+		defer func() { p.r.cur = nil }()
+	}
+	return p.r.failAt(s, err)
+}
+
+// nextChunk of a chunked piece
+func (p *pieceReader) nextChunk() (err error) {
+	r := p.r
+	var l64 int64
+	var more bool
+	if l64, more, err = r.nextChunk(p.total); err != nil {
+		if err == ErrSizeLimit && r.skip {
+			r.cur = nil
+			return r.startSkip(l64, more)
+		}
+		return p.failAt(StageLength, err)
+	}
+	p.n, r.more = l64, more
+	p.total += l64
+	return
+}
+
+// skippable reports whether given error of a chunked
+// piece means that the piece is skipped or that
+// next piece can be found by the Heading
+func (r *reader) skippable(err error) bool {
+	if len(r.heading) > 0 {
+		return errors.Is(err, ErrSizeLimit) ||
+			errors.Is(err, ErrNegativeLength)
+	}
+	var sle *SizeLimitError
+	return errors.As(err, &sle)
+}
+
+func (p *pieceReader) putPart() {
+	if p.part != nil {
+		p.r.put(p.part)
+		p.pre, p.part = nil, nil
+	}
+}
+
+// Read implements io.Reader interface. A timeout
+// error of underlying io.Reader doesn't break it.
+func (p *pieceReader) Read(b []byte) (n int, err error) {
+	r := p.r
+	if r.cur != p {
+		return 0, io.EOF
+	}
+	if len(p.pre) > 0 {
+		n = copy(b, p.pre)
+		p.crc = crc32.Update(p.crc, castagnoli, p.pre[:n])
+		if p.pre = p.pre[n:]; len(p.pre) == 0 {
+			p.putPart()
+		}
+		return
+	}
+	for p.n == 0 && r.more {
+		if err = p.nextChunk(); err != nil {
+			return
+		}
+	}
+	if p.n == 0 {
+		return 0, p.finish()
+	}
+	if int64(len(b)) > p.n {
+		b = b[:p.n]
+	}
+	n, err = r.r.Read(b)
+	r.off += int64(n)
+	p.n -= int64(n)
+	p.crc = crc32.Update(p.crc, castagnoli, b[:n])
+	if err == io.EOF {
+		if p.n > 0 || r.more {
+			err = io.ErrUnexpectedEOF
+		} else {
+			err = nil
+		}
+	}
+	if err != nil {
+		return n, p.fail(err)
+	}
+	if p.n == 0 && !r.more {
+		err = p.finish()
+	}
+	return
+}
+
+// finish the piece verifying its checksum
+func (p *pieceReader) finish() (err error) {
+	r := p.r
+	if err = p.readSum(); err != nil {
+		return p.fail(err)
+	}
+	if r.checksum && binary.BigEndian.Uint32(r.sumb[:]) != p.crc {
+		err = r.frameError(StageChecksum, ErrChecksum)
+	} else {
+		err = io.EOF
+	}
+	r.cur = nil
+	r.reset()
+	return
+}
+
+// pieceWriter is bounded writer of a piece
+type pieceWriter struct {
+	w       *writer
+	n       int64  // bytes to write
+	total   int64  // written bytes of a chunked piece
+	chunked bool   // piece of unknown size
+	crc     uint32 // checksum of written bytes
+}
+
+// NextWriter writes heading and given size, and returns
+// io.WriteCloser for the piece. Exactly size bytes must be
+// written to the io.WriteCloser. It returns ErrSizeLimit
+// if it's asked to write more. The Close writes checksum
+// (if the Checksum option is set), and returns
+// io.ErrShortWrite if the piece is not written to end. The
+// NextWriter never puts written bytes to a Pool. A Writer
+// returns ErrPieceOpen until the piece is written to end.
+//
+// If the Chunked option is set, then the size can be -1.
+// This way, each Write call writes a chunk, and the Close
+// writes last empty chunk. The piece must be closed. Wrap
+// the io.WriteCloser with bufio.Writer to avoid small
+// chunks. The io.WriteCloser returns ErrSizeLimit if
+// entire piece exceeds the MaxSize.
+func (w *writer) NextWriter(size int64) (_ io.WriteCloser, err error) {
+	if w.err != nil {
+		return nil, broken(w.err)
+	}
+	if p := w.cur; p != nil && w.frame == frameHeader &&
+		(p.chunked && size == -1 || p.n == size) {
+		if err = w.writeFrame(); err != nil {
+			return // timeout again
+		}
+		return p, nil // the header is written
+	}
+	if w.frame == framePiece {
+		if err = w.writeFrame(); err != nil {
+			return nil, pending(err)
+		}
+	}
+	if err = w.finish(); err != nil {
+		return
+	}
+	if size < 0 && (size != -1 || !w.chunked) {
+		err = ErrNegativeLength
+		return
+	}
+	if size > int64(w.max) {
+		err = ErrSizeLimit
+		return
+	}
+	p := &pieceWriter{w: w, n: size}
+	w.frame, w.bufs[0] = frameHeader, w.heading
+	if p.chunked = size < 0; p.chunked {
+		p.n = 0
+	} else {
+		w.bufs[1] = w.putLen(int(size))
+	}
+	w.cur = p
+	if err = w.writeFrame(); err != nil {
+		if !isTimeout(err) {
+			w.cur = nil
+		}
+		return
+	}
+	return p, nil
+}
+
+// finish closes current piece writer, if any
+func (w *writer) finish() error {
+	if w.cur == nil {
+		return nil
+	}
+	if w.cur.n > 0 || w.cur.chunked || w.frame == frameHeader {
+		return ErrPieceOpen
+	}
+	return w.cur.Close()
+}
+
+// Write implements io.Writer interface. On a timeout
+// error, the chunk of a chunked piece is written like
+// a piece of the Write: the rest of the chunk is kept,
+// and next Write, the Close or the Flush writes it.
+func (p *pieceWriter) Write(b []byte) (n int, err error) {
+	w := p.w
+	if w.cur != p {
+		return 0, io.ErrClosedPipe
+	}
+	if w.err != nil {
+		return 0, broken(w.err)
+	}
+	if w.frame != 0 {
+		if err = w.writeFrame(); err != nil {
+			return 0, pending(err)
+		}
+	}
+	if p.chunked {
+		if len(b) == 0 {
+			return // empty continuation chunk is useless
+		}
+		if int64(len(b)) > int64(w.max)-p.total {
+			return 0, ErrSizeLimit
+		}
+		p.total += int64(len(b))
+		p.crc = crc32.Update(p.crc, castagnoli, b)
+		w.frame = frameChunk
+		w.bufs[1], w.bufs[2] = w.putChunkLen(len(b)), b
+		return p.writeChunk(b)
+	}
+	if int64(len(b)) > p.n {
+		return 0, ErrSizeLimit
+	}
+	n, err = w.w.Write(b)
+	p.n -= int64(n)
+	p.total += int64(n)
+	p.crc = crc32.Update(p.crc, castagnoli, b[:n])
+	if err != nil {
+		err = w.fail(err)
+	}
+	return
+}
+
+// writeChunk writes frame of a chunk and returns
+// number of written bytes of given chunk
+func (p *pieceWriter) writeChunk(b []byte) (n int, err error) {
+	w := p.w
+	if err = w.writeFrame(); err == nil || w.frame == frameChunk {
+		n = len(b) // the rest is kept after a timeout
+	}
+	return
+}
+
+// Close implements io.Closer interface.
+// On a timeout error, call it again.
+func (p *pieceWriter) Close() (err error) {
+	w := p.w
+	if w.cur != p {
+		return
+	}
+	if w.err != nil {
+		return broken(w.err)
+	}
+	switch w.frame {
+	case frameTrailer:
+		if err = w.writeFrame(); err == nil {
+			w.cur = nil
+		}
+		return
+	case frameHeader, frameChunk:
+		if err = w.writeFrame(); err != nil {
+			return
+		}
+	}
+	if p.n > 0 {
+		w.cur = nil
+		return w.fail(io.ErrShortWrite)
+	}
+	w.frame = frameTrailer
+	if p.chunked {
+		w.bufs[1] = w.putLen(0)
+	}
+	if w.checksum {
+		binary.BigEndian.PutUint32(w.sumb[:], p.crc)
+		w.bufs[3] = w.sumb[:]
+	}
+	if err = w.writeFrame(); err != nil {
+		if !isTimeout(err) {
+			w.cur = nil
+		}
+		return
+	}
+	w.cur = nil
+	return
+}
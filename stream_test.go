@@ -0,0 +1,737 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+func TestWriter_NextWriter(t *testing.T) {
+	for _, c := range testConfigs(nil) {
+		buf := new(bytes.Buffer)
+		w, err := NewWriter(buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pw, err := w.NextWriter(int64(len("Hello, Lend!")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(pw, "Hello, ")
+		io.WriteString(pw, "Lend!")
+		if err := pw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write([]byte("next")); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"Hello, Lend!", "next"} {
+			if p, err := r.Read(); err != nil {
+				t.Fatalf("%+v: unexpected error: %v", c, err)
+			} else if string(p) != want {
+				t.Errorf("%+v: want %q, got %q", c, want, string(p))
+			}
+		}
+	}
+}
+
+func TestReader_NextReader(t *testing.T) {
+	for _, c := range testConfigs(nil) {
+		buf := new(bytes.Buffer)
+		w, err := NewWriter(buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{"Hello, Lend!", "", "Bye"} {
+			w.Write([]byte(p))
+		}
+		for _, want := range []string{"Hello, Lend!", "", "Bye"} {
+			pr, size, err := r.NextReader()
+			if err != nil {
+				t.Fatalf("%+v: unexpected error: %v", c, err)
+			}
+			if size != int64(len(want)) {
+				t.Errorf("%+v: wrong size, want %d, got %d", c, len(want), size)
+			}
+			if p, err := io.ReadAll(iotest.OneByteReader(pr)); err != nil {
+				t.Fatalf("%+v: unexpected error: %v", c, err)
+			} else if string(p) != want {
+				t.Errorf("%+v: want %q, got %q", c, want, string(p))
+			}
+		}
+	}
+}
+
+func TestReader_NextReader_drain(t *testing.T) {
+	for _, c := range testConfigs(nil) {
+		buf := new(bytes.Buffer)
+		w, _ := NewWriter(buf, c)
+		r, err := NewReader(buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("Hello, Lend!"))
+		w.Write([]byte("next"))
+		w.Write([]byte("last"))
+		pr, _, err := r.NextReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		head := make([]byte, 5)
+		io.ReadFull(pr, head)
+		pr2, _, err := r.NextReader()
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %v", c, err)
+		}
+		if n, err := pr.Read(head); n != 0 || err != io.EOF {
+			t.Errorf("%+v: stale reader returns %d, %v", c, n, err)
+		}
+		if p, err := io.ReadAll(pr2); err != nil || string(p) != "next" {
+			t.Errorf("%+v: unexpected result %q, %v", c, p, err)
+		}
+		pr2.Read(head) // stale
+		if p, err := r.Read(); err != nil || string(p) != "last" {
+			t.Errorf("%+v: unexpected result %q, %v", c, p, err)
+		}
+	}
+}
+
+func TestReader_NextReader_drain_error(t *testing.T) {
+	buf := writePieces(t, "Hello, Lend!")
+	buf.Truncate(buf.Len() - 1)
+	r, err := NewReader(buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.NextReader(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("wrong error, want io.ErrUnexpectedEOF, got:", err)
+	}
+}
+
+func TestReader_NextReader_truncated(t *testing.T) {
+	for _, c := range testConfigs(nil) {
+		buf := new(bytes.Buffer)
+		w, _ := NewWriter(buf, c)
+		r, err := NewReader(buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("Hello, Lend!"))
+		buf.Truncate(buf.Len() - 1)
+		pr, _, err := r.NextReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(pr); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%+v: wrong error, want io.ErrUnexpectedEOF, got: %v",
+				c, err)
+		}
+	}
+}
+
+func TestReader_NextReader_checksum(t *testing.T) {
+	c := &Config{MaxSize: 100, Checksum: true}
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, c)
+	r, err := NewReader(buf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Hello, Lend!"))
+	buf.Bytes()[5] ^= 0xff
+	pr, _, err := r.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(pr); !errors.Is(err, ErrChecksum) {
+		t.Error("wrong error, want ErrChecksum, got:", err)
+	}
+}
+
+func TestReader_NextReader_errors(t *testing.T) {
+	buf := writePieces(t, "Hello, Lend!")
+	r, err := NewReader(buf, &Config{MaxSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.NextReader(); !errors.Is(err, ErrSizeLimit) {
+		t.Error("wrong error, want ErrSizeLimit, got:", err)
+	}
+	r, err = NewReader(errorReader{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.NextReader(); err == nil {
+		t.Error("missing error")
+	}
+}
+
+func TestReader_NextReader_budget_incremental(t *testing.T) {
+	size := 3 * incrementalChunk
+	data := bytes.Repeat([]byte("0123456789"), size/10)
+	other := size - incrementalChunk // held by another Reader
+	b := NewBudget(size)
+	b.TryAcquire(other)
+	r, err := NewReader(writePieces(t, string(data)), &Config{
+		MaxSize:     maxInt32,
+		Budget:      b,
+		Incremental: true,
+		Checksum:    false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); err != ErrBudgetExhausted {
+		t.Fatal("wrong error, want ErrBudgetExhausted, got:", err)
+	}
+	pr, n, err := r.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("wrong size, want %d, got %d", len(data), n)
+	}
+	if b.Used() != other {
+		t.Error("budget is not released:", b.Used())
+	}
+	if p, err := io.ReadAll(pr); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(p, data) {
+		t.Error("wrong data")
+	}
+}
+
+func TestWriter_NextWriter_errors(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, &Config{MaxSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.NextWriter(-1); err != ErrNegativeLength {
+		t.Error("wrong error, want ErrNegativeLength, got:", err)
+	}
+	if _, err := w.NextWriter(6); err != ErrSizeLimit {
+		t.Error("wrong error, want ErrSizeLimit, got:", err)
+	}
+	pw, err := w.NextWriter(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pw.Write([]byte("abcd")); err != ErrSizeLimit {
+		t.Error("wrong error, want ErrSizeLimit, got:", err)
+	}
+	pw.Write([]byte("a"))
+	if err := w.Write(nil); err != ErrPieceOpen {
+		t.Error("wrong error, want ErrPieceOpen, got:", err)
+	}
+	if _, err := w.NextWriter(1); err != ErrPieceOpen {
+		t.Error("wrong error, want ErrPieceOpen, got:", err)
+	}
+	if err := pw.Close(); err != io.ErrShortWrite {
+		t.Error("wrong error, want io.ErrShortWrite, got:", err)
+	}
+	if _, err := pw.Write([]byte("a")); err != io.ErrClosedPipe {
+		t.Error("wrong error, want io.ErrClosedPipe, got:", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestWriter_NextWriter_autoclose(t *testing.T) {
+	c := &Config{MaxSize: 5, Checksum: true}
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, c)
+	r, err := NewReader(buf, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := w.NextWriter(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw.Write([]byte("abc"))
+	// not closed
+	if err := w.Write([]byte("def")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"abc", "def"} {
+		if p, err := r.Read(); err != nil || string(p) != want {
+			t.Errorf("unexpected result %q, %v", p, err)
+		}
+	}
+}
+
+func TestWriter_NextWriter_write_errors(t *testing.T) {
+	if w, _ := NewWriter(errorWriter{}, nil); w != nil {
+		if _, err := w.NextWriter(1); err == nil {
+			t.Error("missing error")
+		}
+	}
+	var swe secondWriteErr
+	w, _ := NewWriter(&swe, &Config{MaxSize: 5, Checksum: true})
+	pw, err := w.NextWriter(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.Close(); err == nil {
+		t.Error("missing error")
+	}
+}
+
+// chunked sets the Chunked option of given config
+func chunked(c *Config) {
+	c.Chunked = true
+}
+
+// writeChunked writes given chunks as one chunked piece
+func writeChunked(t *testing.T, w FrameWriter, chunks ...string) {
+	pw, err := w.NextWriter(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range chunks {
+		if n, err := io.WriteString(pw, c); err != nil {
+			t.Fatal(err)
+		} else if n != len(c) {
+			t.Fatalf("short write: %d of %d", n, len(c))
+		}
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriter_NextWriter_chunked(t *testing.T) {
+	for _, c := range testConfigs(chunked) {
+		buf := new(bytes.Buffer)
+		w, err := NewWriter(buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeChunked(t, w, "Hello", ", ", "", "Lend!")
+		writeChunked(t, w)
+		w.Write([]byte("regular"))
+		writeChunked(t, w, "Bye")
+		for _, want := range []string{"Hello, Lend!", "", "regular", "Bye"} {
+			p, err := r.Read()
+			if err != nil {
+				t.Fatalf("%+v: unexpected error: %v", c, err)
+			}
+			if string(p) != want {
+				t.Errorf("%+v: want %q, got %q", c, want, string(p))
+			}
+			if c.Budget != nil {
+				c.Budget.Release(len(p))
+			}
+		}
+		if c.Budget != nil && c.Budget.Used() != 0 {
+			t.Errorf("%+v: budget is not released: %d", c, c.Budget.Used())
+		}
+	}
+}
+
+func TestWriter_NextWriter_chunked_encoding(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, &Config{MaxSize: 100, Chunked: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeChunked(t, w, "abc", "d")
+	want := []byte{0x80, 0, 0, 3, 'a', 'b', 'c', 0x80, 0, 0, 1, 'd', 0, 0, 0, 0}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("wrong encoding, want %v, got %v", want, buf.Bytes())
+	}
+	// without the Chunked
+	for _, c := range []*Config{
+		{MaxSize: 100},
+		{MaxSize: 100, Varint: true},
+	} {
+		buf.Reset()
+		w, _ = NewWriter(buf, &Config{MaxSize: 100, Chunked: true,
+			Varint: c.Varint})
+		writeChunked(t, w, "abc", "d")
+		r, _ := NewReader(buf, c)
+		if _, err := r.Read(); err == nil {
+			t.Errorf("%+v: missing error", c)
+		}
+	}
+}
+
+func TestReader_NextReader_chunked(t *testing.T) {
+	for _, c := range testConfigs(chunked) {
+		buf := new(bytes.Buffer)
+		w, _ := NewWriter(buf, c)
+		r, err := NewReader(buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeChunked(t, w, "Hello", ", ", "Lend!")
+		writeChunked(t, w, "skip", "me")
+		writeChunked(t, w, "last")
+		pr, size, err := r.NextReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != -1 {
+			t.Errorf("%+v: wrong size, want -1, got %d", c, size)
+		}
+		if p, err := io.ReadAll(iotest.OneByteReader(pr)); err != nil {
+			t.Fatalf("%+v: unexpected error: %v", c, err)
+		} else if string(p) != "Hello, Lend!" {
+			t.Errorf("%+v: want %q, got %q", c, "Hello, Lend!", string(p))
+		}
+		if pr, _, err = r.NextReader(); err != nil {
+			t.Fatal(err)
+		}
+		pr.Read(make([]byte, 2))
+		if p, err := r.Read(); err != nil || string(p) != "last" {
+			t.Errorf("%+v: unexpected result %q, %v", c, p, err)
+		}
+	}
+}
+
+func TestReader_chunked_size_limit(t *testing.T) {
+	for _, c := range []*Config{
+		{MaxSize: 5, Chunked: true},
+		{MaxSize: 5, Chunked: true, Varint: true},
+		{MaxSize: 5, Chunked: true, Checksum: true},
+	} {
+		buf := new(bytes.Buffer)
+		w, _ := NewWriter(buf, &Config{MaxSize: 100, Chunked: true,
+			Varint: c.Varint, Checksum: c.Checksum})
+		writeChunked(t, w, "abc", "def", "gh")
+		writeChunked(t, w, "ok")
+		data := buf.Bytes()
+		// broken
+		r, _ := NewReader(bytes.NewReader(data), c)
+		if _, err := r.Read(); !errors.Is(err, ErrSizeLimit) {
+			t.Errorf("%+v: wrong error, want ErrSizeLimit, got %v", c, err)
+		}
+		// skip
+		c.SkipOversize = true
+		r, _ = NewReader(bytes.NewReader(data), c)
+		var sle *SizeLimitError
+		if _, err := r.Read(); !errors.As(err, &sle) {
+			t.Errorf("%+v: wrong error, want *SizeLimitError, got %v", c, err)
+		} else if sle.Size != 8 {
+			t.Errorf("%+v: wrong size, want 8, got %d", c, sle.Size)
+		}
+		if p, err := r.Read(); err != nil || string(p) != "ok" {
+			t.Errorf("%+v: unexpected result %q, %v", c, p, err)
+		}
+		// skip (NextReader)
+		r, _ = NewReader(bytes.NewReader(data), c)
+		pr, _, err := r.NextReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(pr); !errors.Is(err, ErrSizeLimit) {
+			t.Errorf("%+v: wrong error, want ErrSizeLimit, got %v", c, err)
+		}
+		if p, err := r.Read(); err != nil || string(p) != "ok" {
+			t.Errorf("%+v: unexpected result %q, %v", c, p, err)
+		}
+		// drain
+		r, _ = NewReader(bytes.NewReader(data), c)
+		if _, _, err = r.NextReader(); err != nil {
+			t.Fatal(err)
+		}
+		if p, err := r.Read(); err != nil || string(p) != "ok" {
+			t.Errorf("%+v: unexpected result %q, %v", c, p, err)
+		}
+	}
+}
+
+func TestReader_chunked_size_limit_heading(t *testing.T) {
+	heading := []byte("HEAD")
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, &Config{MaxSize: 100, Chunked: true,
+		Heading: heading})
+	writeChunked(t, w, "abc", "def")
+	writeChunked(t, w, "ok")
+	r, _ := NewReader(buf, &Config{MaxSize: 5, Chunked: true,
+		Heading: heading})
+	if p, err := r.Read(); err != nil || string(p) != "ok" {
+		t.Errorf("unexpected result %q, %v", p, err)
+	}
+}
+
+func TestReader_chunked_truncated(t *testing.T) {
+	c := &Config{MaxSize: 100, Chunked: true}
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, c)
+	writeChunked(t, w, "abc", "def")
+	data := buf.Bytes()
+	for _, cut := range []int{3, 7, 9, 13} {
+		r, _ := NewReader(bytes.NewReader(data[:len(data)-cut]), c)
+		if _, err := r.Read(); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("cut %d: wrong error, want io.ErrUnexpectedEOF, got %v",
+				cut, err)
+		}
+		r, _ = NewReader(bytes.NewReader(data[:len(data)-cut]), c)
+		pr, _, err := r.NextReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(pr); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("cut %d: wrong error, want io.ErrUnexpectedEOF, got %v",
+				cut, err)
+		}
+	}
+}
+
+func TestReader_chunked_large(t *testing.T) {
+	c := &Config{MaxSize: 1 << 20, Chunked: true, Pool: new(maxPool)}
+	buf := new(bytes.Buffer)
+	w, _ := NewWriter(buf, c)
+	r, _ := NewReader(buf, c)
+	pw, err := w.NextWriter(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(data)
+	for i := 0; i < len(data); i += 1000 {
+		pw.Write(data[i : i+1000])
+	}
+	pw.Close()
+	if p, err := r.Read(); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Error("wrong data")
+	}
+	if mp := c.Pool.(*maxPool); mp.gets > 10 {
+		t.Error("too many allocations:", mp.gets)
+	}
+}
+
+func TestWriter_NextWriter_chunked_errors(t *testing.T) {
+	w, err := NewWriter(new(bytes.Buffer), &Config{MaxSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.NextWriter(-1); err != ErrNegativeLength {
+		t.Error("wrong error, want ErrNegativeLength, got:", err)
+	}
+	w, _ = NewWriter(new(bytes.Buffer), &Config{MaxSize: 5, Chunked: true})
+	if _, err := w.NextWriter(-2); err != ErrNegativeLength {
+		t.Error("wrong error, want ErrNegativeLength, got:", err)
+	}
+	pw, err := w.NextWriter(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw.Write([]byte("abc"))
+	if _, err := pw.Write([]byte("def")); err != ErrSizeLimit {
+		t.Error("wrong error, want ErrSizeLimit, got:", err)
+	}
+	if err := w.Write(nil); err != ErrPieceOpen {
+		t.Error("wrong error, want ErrPieceOpen, got:", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Error(err)
+	}
+	for _, c := range []*Config{
+		{MaxSize: 5, Chunked: true, Heading: []byte("H")},
+		{MaxSize: 5, Chunked: true},
+	} {
+		w, _ = NewWriter(errorWriter{}, c)
+		if pw, err = w.NextWriter(-1); err == nil {
+			if _, err := pw.Write([]byte("a")); err == nil {
+				t.Errorf("%+v: missing error", c)
+			}
+			if err := pw.Close(); err == nil {
+				t.Errorf("%+v: missing error", c)
+			}
+		}
+	}
+}
+
+// readAllRetry reads given io.Reader to end
+// retrying on timeouts
+func readAllRetry(r io.Reader) (p []byte, err error) {
+	b := make([]byte, 4)
+	for {
+		n, err := r.Read(b)
+		p = append(p, b[:n]...)
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil && !isTimeout(err) {
+			return p, err
+		}
+	}
+}
+
+func TestReader_NextReader_timeout(t *testing.T) {
+	for _, c := range append(testConfigs(nil), testConfigs(chunked)...) {
+		buf := new(bytes.Buffer)
+		w, _ := NewWriter(buf, c)
+		if c.Chunked {
+			writeChunked(t, w, "Hello", ", ", "Lend!")
+			writeChunked(t, w, "skip", "me")
+			writeChunked(t, w, "Bye")
+		} else {
+			w.Write([]byte("Hello, Lend!"))
+			w.Write([]byte("skip me"))
+			w.Write([]byte("Bye"))
+		}
+		r, err := NewReader(&timeoutReader{r: buf}, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pr, _, err := r.NextReader()
+		for ; isTimeout(err); pr, _, err = r.NextReader() {
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, err := readAllRetry(pr); err != nil {
+			t.Fatalf("%+v: unexpected error: %v", c, err)
+		} else if string(p) != "Hello, Lend!" {
+			t.Errorf("%+v: want %q, got %q", c, "Hello, Lend!", string(p))
+		}
+		for pr, _, err = r.NextReader(); isTimeout(err); pr, _, err = r.NextReader() {
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		pr.Read(make([]byte, 2))
+		p, err := r.Read() // drain and read
+		for ; isTimeout(err); p, err = r.Read() {
+		}
+		if err != nil || string(p) != "Bye" {
+			t.Errorf("%+v: unexpected result %q, %v", c, p, err)
+		}
+		if c.Budget != nil {
+			c.Budget.Release(len(p))
+		}
+	}
+}
+
+func TestWriter_NextWriter_timeout(t *testing.T) {
+	for _, c := range append(testConfigs(nil), testConfigs(chunked)...) {
+		buf := new(bytes.Buffer)
+		w, _ := NewWriter(&timeoutWriter{w: buf}, c)
+		size := int64(len("Hello, Lend!"))
+		if c.Chunked {
+			size = -1
+		}
+		pw, err := w.NextWriter(size)
+		for ; isTimeout(err); pw, err = w.NextWriter(size) {
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{"Hello, ", "Lend!"} {
+			for b := []byte(s); len(b) > 0; {
+				n, err := pw.Write(b)
+				if err != nil && !isTimeout(err) {
+					t.Fatal(err)
+				}
+				b = b[n:]
+			}
+		}
+		for err = pw.Close(); isTimeout(err); err = pw.Close() {
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _ := NewReader(buf, c)
+		if p, err := r.Read(); err != nil || string(p) != "Hello, Lend!" {
+			t.Errorf("%+v: unexpected result %q, %v", c, p, err)
+		}
+	}
+}
+
+func TestWriter_NextWriter_broken(t *testing.T) {
+	w, _ := NewWriter(new(bytes.Buffer), &Config{MaxSize: 5})
+	pw, err := w.NextWriter(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw.Write([]byte("a"))
+	if err := pw.Close(); err != io.ErrShortWrite {
+		t.Fatal("wrong error, want io.ErrShortWrite, got:", err)
+	}
+	if w.Err() != io.ErrShortWrite {
+		t.Error("wrong Err, want io.ErrShortWrite, got:", w.Err())
+	}
+	if err := w.Write(nil); !errors.Is(err, ErrBroken) {
+		t.Error("wrong error, want ErrBroken, got:", err)
+	}
+	var swe secondWriteErr
+	w, _ = NewWriter(&swe, &Config{MaxSize: 5})
+	if pw, err = w.NextWriter(3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pw.Write([]byte("abc")); err == nil {
+		t.Fatal("missing error")
+	}
+	if _, err := pw.Write([]byte("abc")); !errors.Is(err, ErrBroken) {
+		t.Error("wrong error, want ErrBroken, got:", err)
+	}
+	if err := pw.Close(); !errors.Is(err, ErrBroken) {
+		t.Error("wrong error, want ErrBroken, got:", err)
+	}
+}
+
+func TestReader_NextReader_broken(t *testing.T) {
+	buf := writePieces(t, "Hello, Lend!", "next")
+	buf.Truncate(buf.Len() - 10)
+	r, _ := NewReader(buf, nil)
+	pr, _, err := r.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(pr); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal("wrong error, want io.ErrUnexpectedEOF, got:", err)
+	}
+	if _, err := r.Read(); !errors.Is(err, ErrBroken) {
+		t.Error("wrong error, want ErrBroken, got:", err)
+	}
+}
@@ -0,0 +1,133 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"io"
+	"sync"
+)
+
+// syncWriter is a Writer safe for concurrent use
+type syncWriter struct {
+	mu sync.Mutex
+	w  *writer
+}
+
+// NewSyncWriter creates a FrameWriter that is safe for
+// concurrent use. Each frame is written atomically.
+// A frame is encoded and written under a lock, thus
+// use the BufferSize option to reduce contention.
+// The Writer is locked by the NextWriter until
+// Close of returned io.WriteCloser.
+func NewSyncWriter(w io.Writer, c *Config) (FrameWriter, error) {
+	q, err := NewWriter(w, c)
+	if err != nil {
+		return nil, err
+	}
+	return &syncWriter{w: q.(*writer)}, nil
+}
+
+func (s *syncWriter) Write(piece []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(piece)
+}
+
+func (s *syncWriter) WriteOwned(piece []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.WriteOwned(piece)
+}
+
+func (s *syncWriter) WriteBorrowed(piece []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.WriteBorrowed(piece)
+}
+
+func (s *syncWriter) WriteBatch(pieces [][]byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.WriteBatch(pieces)
+}
+
+// NextWriter locks the Writer until Close of returned
+// io.WriteCloser. If the Close returns a timeout, then
+// the Writer is still locked, and the Close can be
+// called again.
+func (s *syncWriter) NextWriter(size int64) (io.WriteCloser, error) {
+	s.mu.Lock()
+	pw, err := s.w.NextWriter(size)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	return &syncPieceWriter{pw: pw, s: s}, nil
+}
+
+func (s *syncWriter) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Err()
+}
+
+func (s *syncWriter) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Flush()
+}
+
+func (s *syncWriter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
+
+// syncPieceWriter unlocks the syncWriter on Close
+type syncPieceWriter struct {
+	pw     io.WriteCloser
+	s      *syncWriter
+	closed bool
+}
+
+func (p *syncPieceWriter) Write(b []byte) (int, error) {
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return p.pw.Write(b)
+}
+
+func (p *syncPieceWriter) Close() (err error) {
+	if p.closed {
+		return nil
+	}
+	if err = p.pw.Close(); isTimeout(err) {
+		return // keep the lock
+	}
+	p.closed = true
+	p.s.mu.Unlock()
+	return
+}
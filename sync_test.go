@@ -0,0 +1,167 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package lend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncPiece encodes index of a producer and index
+// of a piece of the producer
+func syncPiece(producer, i int) []byte {
+	p := make([]byte, 8, 8+i%64)
+	binary.BigEndian.PutUint32(p, uint32(producer))
+	binary.BigEndian.PutUint32(p[4:], uint32(i))
+	for j := 0; j < i%64; j++ {
+		p = append(p, byte(j))
+	}
+	return p
+}
+
+func TestSyncWriter(t *testing.T) {
+	const producers, pieces = 16, 300
+	for _, c := range []*Config{
+		{MaxSize: 100},
+		{MaxSize: 100, Varint: true, Checksum: true},
+		{MaxSize: 100, BufferSize: 512, FlushInterval: time.Millisecond},
+	} {
+		buf := new(syncBuffer)
+		w, err := NewSyncWriter(buf, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for p := 0; p < producers; p++ {
+			wg.Add(1)
+			go func(p int) {
+				defer wg.Done()
+				for i := 0; i < pieces; {
+					switch i % 3 {
+					case 0:
+						if err := w.Write(syncPiece(p, i)); err != nil {
+							t.Error(err)
+							return
+						}
+						i++
+					case 1:
+						batch := [][]byte{syncPiece(p, i)}
+						if i+1 < pieces {
+							batch = append(batch, syncPiece(p, i+1))
+						}
+						if _, err := w.WriteBatch(batch); err != nil {
+							t.Error(err)
+							return
+						}
+						i += len(batch)
+					default:
+						piece := syncPiece(p, i)
+						pw, err := w.NextWriter(int64(len(piece)))
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						pw.Write(piece[:3])
+						pw.Write(piece[3:])
+						if err := pw.Close(); err != nil {
+							t.Error(err)
+							return
+						}
+						i++
+					}
+				}
+			}(p)
+		}
+		wg.Wait()
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, _ := NewReader(bytes.NewReader(buf.buf.Bytes()), c)
+		var next [producers]int
+		for {
+			piece, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := int(binary.BigEndian.Uint32(piece))
+			i := int(binary.BigEndian.Uint32(piece[4:]))
+			if p >= producers || i != next[p] {
+				t.Fatalf("unexpected piece %d of producer %d", i, p)
+			}
+			if !bytes.Equal(piece, syncPiece(p, i)) {
+				t.Fatal("corrupted piece")
+			}
+			next[p]++
+		}
+		for p, n := range next {
+			if n != pieces {
+				t.Errorf("producer %d: %d pieces", p, n)
+			}
+		}
+	}
+}
+
+func TestSyncWriter_NextWriter_closed(t *testing.T) {
+	w, _ := NewSyncWriter(io.Discard, nil)
+	pw, _ := w.NextWriter(1)
+	pw.Write([]byte("x"))
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pw.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Error("wrong error, want io.ErrClosedPipe, got:", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if err := w.Write([]byte("unlocked")); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if _, err := w.NextWriter(-1); err == nil {
+		t.Error("missing error")
+	}
+	if err := w.Write([]byte("unlocked")); err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func BenchmarkSyncWriter(b *testing.B) {
+	w, _ := NewSyncWriter(io.Discard, &Config{MaxSize: 100})
+	piece := []byte("small piece of data")
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w.Write(piece)
+		}
+	})
+}